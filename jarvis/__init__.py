@@ -0,0 +1,21 @@
+"""The speech recognition pipeline behind run.py, for use in other programs.
+
+    from vosk import Model
+    from jarvis import MicrophoneSource, Transcriber, VoiceActivityDetector
+
+    vad = VoiceActivityDetector(600, 2, 8)
+    transcriber = Transcriber(Model("model/vosk-model-small-en-us-0.15"), vad)
+    for segment in transcriber.start(MicrophoneSource()):
+        print(segment.text)
+
+The other parts run.py wires together, its outputs, servers, commands, model
+downloads and LLM clients, are modules of their own, imported by name.
+"""
+
+from jarvis.audio import (AGC, CHUNK, RATE, SAMPLE_FORMATS, Calibrator, ClipDetector, Downmixer, HighPassFilter,
+                          LevelMeter, NoiseGate, PreEmphasis, PushToTalk, Resampler, SpectralDenoiser,
+                          TransientSuppressor, VoiceActivityDetector, bytes_to_int16, convert_to_int16, int16_to_bytes,
+                          mean_abs_level, peak_level, read_wav, rms_level, to_int16, write_wav)
+from jarvis.sources import AudioSource, FileAudioSource, MicrophoneSource, PipeAudioSource, ThreadedSource
+from jarvis.text import Capitalize, EndPunctuation, Strip, TextChain, TextProcessor
+from jarvis.transcriber import Segment, Transcriber, TurnTracker, Word
@@ -0,0 +1,476 @@
+"""Sample conversion, filters and voice activity detection for 16 kHz mono PCM."""
+
+import logging
+import math
+import statistics
+import threading
+import wave
+from collections import deque
+
+import numpy as np
+
+
+log = logging.getLogger(__name__)
+
+# Vosk models are trained on 16 kHz mono audio, everything is converted to it
+RATE = 16000
+# Samples per chunk, the unit everything downstream of capture works in
+CHUNK = 2048
+
+# Automatic gain control: RMS level to steer towards, the most it may boost,
+# and the RMS below which a chunk is treated as silence and doesn't adapt the gain
+AGC_TARGET_RMS = 3000
+AGC_MAX_GAIN = 8.0
+AGC_NOISE_FLOOR = 50
+
+# Lowest threshold calibration will pick, so a dead silent input doesn't
+# leave every chunk counting as speech
+CALIBRATE_MIN_LEVEL = 50
+
+# Samples this close to full scale count as clipped, int16 saturates at 32767
+CLIP_LEVEL = 32000
+
+# Pitch estimation: the range of voice pitch in Hz searched for, and how
+# strongly periodic a chunk has to be to count as voiced at all
+PITCH_MIN = 60
+PITCH_MAX = 400
+PITCH_VOICING = 0.3
+
+# Level meter: the level shown as empty, in dB below full scale, and how much
+# of the way to a new level it moves per chunk going up and coming down
+METER_FLOOR_DB = -60
+METER_ATTACK = 0.6
+METER_RELEASE = 0.15
+
+# Gain a closed noise gate leaves, -20 dB so it softens rather than silences
+GATE_FLOOR = 0.1
+
+# Click suppression: seconds per frame the level is measured over, the gain
+# left on a click, the level the background is never taken to be below, and
+# how fast the background follows the room
+CLICK_FRAME = 0.005
+CLICK_FLOOR = 0.05
+CLICK_NOISE_FLOOR = 50
+CLICK_ADAPT = 0.02
+
+# Spectral subtraction: FFT frame and hop in samples, how much of the noise
+# estimate to subtract, the share of each bin always kept so the leftover
+# noise doesn't turn into warbling, and how fast the estimate adapts
+DENOISE_FRAME = 512
+DENOISE_HOP = 256
+DENOISE_OVERSUBTRACT = 1.5
+DENOISE_FLOOR = 0.05
+DENOISE_ADAPT = 0.05
+
+# Capture formats: packed little-endian 16 and 24-bit integers and 32-bit float
+SAMPLE_FORMATS = ("s16", "s24", "f32")
+
+# WAV encodings other than PCM that turn up, by format tag, for the error message
+WAV_FORMATS = {2: "ADPCM", 3: "floating point", 6: "A-law", 7: "μ-law", 17: "IMA ADPCM", 85: "MP3"}
+
+
+def bytes_to_int16(data):
+    # little-endian 16-bit PCM as PyAudio and Vosk use it, viewed in place
+    # rather than copied as this runs on every chunk; a trailing odd byte
+    # can't form a sample and is dropped
+    return np.frombuffer(data, dtype="<i2", count=len(data) // 2)
+
+def int16_to_bytes(samples) -> bytes:
+    # tobytes() makes the one copy needed, don't make another converting
+    # samples that are already 16-bit
+    return samples.astype("<i2", copy=False).tobytes()
+
+def to_int16(samples):
+    return np.clip(np.rint(samples), -32768, 32767).astype(np.int16)
+
+def peak_level(samples) -> float:
+    return float(np.max(np.abs(samples.astype(np.int32))))
+
+def rms_level(samples) -> float:
+    # closer to perceived loudness than the peak and less thrown off by clicks
+    return float(np.sqrt(np.mean(samples.astype(np.float64) ** 2)))
+
+def mean_abs_level(samples) -> float:
+    return float(np.mean(np.abs(samples.astype(np.int32))))
+
+def estimate_pitch(samples, rate=RATE) -> float|None:
+    """The fundamental frequency of a voiced chunk by autocorrelation, None
+    for noise and unvoiced sounds."""
+    x = samples.astype(np.float64)
+    x -= x.mean()
+    lo, hi = rate // PITCH_MAX, rate // PITCH_MIN
+    if len(x) <= hi:
+        return None
+    # autocorrelation through the FFT, padded so it doesn't wrap around
+    spectrum = np.fft.rfft(x, 2 * len(x))
+    ac = np.fft.irfft(spectrum * np.conj(spectrum))[:len(x)]
+    if ac[0] <= 0:
+        return None
+    lag = lo + int(np.argmax(ac[lo:hi]))
+    if ac[lag] < PITCH_VOICING * ac[0]:
+        return None
+    return rate / lag
+
+class VoiceActivityDetector:
+    def __init__(self, threshold, enter_frames, exit_frames):
+        self.threshold = threshold
+        self.speaking = False
+        self.loud = 0
+        self.quiet = 0
+        self.set_frames(enter_frames, exit_frames)
+
+    def set_frames(self, enter_frames, exit_frames):
+        if enter_frames < 1 or exit_frames < 1:
+            raise ValueError("VAD frame counts must be at least 1")
+        self.enter_frames = enter_frames
+        self.exit_frames = exit_frames
+
+    def update(self, amp) -> bool:
+        if amp >= self.threshold:
+            self.loud += 1
+            self.quiet = 0
+        else:
+            self.quiet += 1
+            self.loud = 0
+        if not self.speaking and self.loud >= self.enter_frames:
+            self.speaking = True
+        elif self.speaking and self.quiet >= self.exit_frames:
+            self.speaking = False
+        return self.speaking
+
+    def is_speaking(self) -> bool:
+        return self.speaking
+
+    def reset(self):
+        self.speaking = False
+        self.loud = 0
+        self.quiet = 0
+
+class PushToTalk(VoiceActivityDetector):
+    """Stands in for the VAD, speaking exactly while held is set whatever the
+    level. The threshold still decides which audio counts as voiced."""
+
+    def __init__(self, threshold, held=None):
+        super().__init__(threshold, 1, 1)
+        self.held = held or threading.Event()
+
+    def update(self, amp) -> bool:
+        self.speaking = self.held.is_set()
+        return self.speaking
+
+class Calibrator:
+    """Sets a VAD's threshold to a multiple of the ambient level, measured over
+    the first window chunks and again after every stretch of that many chunks
+    of silence."""
+
+    def __init__(self, vad, multiplier, window, every):
+        self.vad = vad
+        self.multiplier = multiplier
+        self.every = every
+        self.levels = deque(maxlen=window)
+        self.quiet = 0
+        self.calibrated = False
+
+    def update(self, level, speaking) -> bool:
+        """Takes a chunk's level, returning False while still measuring the first window."""
+        if speaking:
+            self.quiet = 0
+            return True
+        self.levels.append(level)
+        self.quiet += 1
+        if self.calibrated and self.quiet >= self.every or not self.calibrated and len(self.levels) == self.levels.maxlen:
+            # the median shrugs off the odd click in the window
+            threshold = max(self.multiplier * statistics.median(self.levels), CALIBRATE_MIN_LEVEL)
+            if not self.calibrated or abs(threshold - self.vad.threshold) > 0.1 * self.vad.threshold:
+                log.info("Ambient level %.0f, speech threshold set to %.0f", statistics.median(self.levels), threshold)
+            self.vad.threshold = threshold
+            self.calibrated = True
+            self.quiet = 0
+        return self.calibrated
+
+class ClipDetector:
+    """Counts samples at full scale, reporting each window of audio in which
+    more than fraction of them were."""
+
+    def __init__(self, fraction, window=RATE):
+        self.fraction = fraction
+        self.window = window
+        self.samples = 0
+        self.clipped = 0
+
+    def update(self, samples) -> bool:
+        """Takes a chunk, returning True when it completes a window that clipped."""
+        self.samples += len(samples)
+        self.clipped += int(np.count_nonzero(np.abs(samples.astype(np.int32)) >= CLIP_LEVEL))
+        if self.samples < self.window:
+            return False
+        clipping = self.clipped > self.fraction * self.samples
+        self.samples = self.clipped = 0
+        return clipping
+
+class LevelMeter:
+    """Turns chunk levels into a smooth 0-1 reading for a meter, on a dB
+    scale so quiet speech still moves it, quick to rise and slow to fall."""
+
+    def __init__(self, attack=METER_ATTACK, release=METER_RELEASE):
+        self.attack = attack
+        self.release = release
+        self.value = 0.0
+
+    def update(self, level) -> float:
+        db = 20 * math.log10(max(level, 1) / 32767)
+        target = min(max(1 - db / METER_FLOOR_DB, 0.0), 1.0)
+        self.value += (target - self.value) * (self.attack if target > self.value else self.release)
+        return self.value
+
+class HighPassFilter:
+    """First-order high-pass, keeping its state so it's continuous across chunks."""
+
+    def __init__(self, cutoff, rate=RATE):
+        rc = 1 / (2 * math.pi * cutoff)
+        self.alpha = rc / (rc + 1 / rate)
+        self.prev_x = 0.0
+        self.prev_y = 0.0
+
+    def process(self, samples):
+        out = np.empty(len(samples))
+        a, px, py = self.alpha, self.prev_x, self.prev_y
+        for i, x in enumerate(samples.tolist()):
+            py = a * (py + x - px)
+            px = x
+            out[i] = py
+        self.prev_x, self.prev_y = px, py
+        return to_int16(out)
+
+class PreEmphasis:
+    """First-order high-frequency boost, y[n] = x[n] - coefficient * x[n-1],
+    carrying the last sample across chunks."""
+
+    def __init__(self, coefficient=0.97):
+        self.coefficient = coefficient
+        self.prev = 0.0
+
+    def process(self, samples):
+        x = samples.astype(np.float64)
+        if not len(x):
+            return samples
+        out = x - self.coefficient * np.concatenate([[self.prev], x[:-1]])
+        self.prev = x[-1]
+        return to_int16(out)
+
+class AGC:
+    """Steers chunk RMS towards a target level with a smoothed gain."""
+
+    def __init__(self, target=AGC_TARGET_RMS, max_gain=AGC_MAX_GAIN, floor=AGC_NOISE_FLOOR, smoothing=0.1):
+        self.target = target
+        self.max_gain = max_gain
+        self.floor = floor
+        self.smoothing = smoothing
+        self.gain = 1.0
+
+    def process(self, samples):
+        level = rms_level(samples)
+        if level > self.floor:
+            desired = min(self.target / level, self.max_gain)
+            self.gain += self.smoothing * (desired - self.gain)
+        # never push the loudest sample past full scale
+        peak = peak_level(samples)
+        gain = min(self.gain, 32767 / peak) if peak else self.gain
+        return to_int16(samples * gain)
+
+class NoiseGate:
+    """Attenuates samples below a threshold, with attack and release times in
+    seconds smoothing the gain so quiet onsets and tails of words survive."""
+
+    def __init__(self, threshold, attack, release, floor=GATE_FLOOR, rate=RATE):
+        self.threshold = threshold
+        self.attack = 1 - math.exp(-1 / (attack * rate))
+        self.release = 1 - math.exp(-1 / (release * rate))
+        self.floor = floor
+        self.gain = floor
+
+    def process(self, samples):
+        out = np.empty(len(samples))
+        g, t, floor = self.gain, self.threshold, self.floor
+        for i, x in enumerate(samples.tolist()):
+            # zero crossings of loud speech dip below the threshold too, a
+            # release much longer than a pitch period rides over them
+            target = 1.0 if abs(x) >= t else floor
+            g += (target - g) * (self.attack if target > g else self.release)
+            out[i] = x * g
+        self.gain = g
+        return to_int16(out)
+
+class TransientSuppressor:
+    """Turns down bursts like key clicks: ratio times louder than the
+    background and over within max_length seconds, when speech stays loud
+    for longer. Output lags input by a little more than max_length, enough to
+    see whether a burst has ended."""
+
+    def __init__(self, max_length, ratio, rate=RATE):
+        self.frame = round(CLICK_FRAME * rate)
+        self.max_frames = max(1, round(max_length / CLICK_FRAME))
+        self.ratio = ratio
+        self.pending = np.zeros((self.max_frames + 1) * self.frame)  # input not yet decided on
+        self.background = float(CLICK_NOISE_FLOOR)  # RMS of the frames between bursts
+        self.run = 0  # loud frames at the end of the output so far
+
+    def process(self, samples):
+        x = np.concatenate([self.pending, samples.astype(np.float64)])
+        n = len(x) // self.frame
+        frames = x[:n * self.frame].reshape(n, self.frame)
+        rms = np.sqrt(np.mean(frames ** 2, axis=1))
+        loud = rms > self.background * self.ratio
+        gain = np.ones(n)
+        # frames the lookahead after them covers; the rest wait for the next chunk
+        ready = n - (self.max_frames + 1)
+        i = 0
+        while i < ready:
+            if not loud[i]:
+                self.background = max(self.background + (rms[i] - self.background) * CLICK_ADAPT, CLICK_NOISE_FLOOR)
+                i += 1
+                continue
+            end = i
+            while end < n and loud[end]:
+                end += 1
+            # a burst still going at the end of the lookahead is too long to be
+            # a click; one that started in an earlier chunk counts from there
+            if end < n and end - i + (self.run if i == 0 else 0) <= self.max_frames:
+                gain[i:end] = CLICK_FLOOR
+            i = end
+        ready = max(ready, 0)
+        trailing = 0
+        while trailing < ready and loud[ready - 1 - trailing]:
+            trailing += 1
+        self.run = self.run + ready if trailing == ready else trailing
+        self.pending = x[ready * self.frame:]
+        return to_int16((frames[:ready] * gain[:ready, None]).ravel())
+
+    def flush(self):
+        """Returns the input still held back for the lookahead, at the end of
+        the audio. It's left as it is, there's no telling whether a burst
+        there was about to stop."""
+        out = to_int16(self.pending)
+        self.pending = np.zeros((self.max_frames + 1) * self.frame)
+        self.run = 0
+        return out
+
+class SpectralDenoiser:
+    """Subtracts a running estimate of stationary noise (fans, hum) from the
+    spectrum, frame by overlapping frame. Output lags input by one hop."""
+
+    def __init__(self, frame=DENOISE_FRAME, hop=DENOISE_HOP):
+        self.frame = frame
+        self.hop = hop
+        # square root of a periodic Hann window on both analysis and
+        # synthesis sums back to unity at 50% overlap
+        self.window = np.sqrt(np.hanning(frame + 1)[:-1])
+        self.pending = np.zeros(frame - hop)  # input not yet covered by a whole frame
+        self.tail = np.zeros(frame - hop)  # output still waiting for the next frame's overlap
+        self.noise = None  # magnitude spectrum
+
+    def process(self, samples, learn):
+        x = np.concatenate([self.pending, samples.astype(np.float64)])
+        n = (len(x) - self.frame) // self.hop + 1 if len(x) >= self.frame else 0
+        out = np.zeros(n * self.hop + self.frame - self.hop)
+        out[:len(self.tail)] += self.tail
+        for i in range(n):
+            spectrum = np.fft.rfft(x[i * self.hop:i * self.hop + self.frame] * self.window)
+            magnitude = np.abs(spectrum)
+            if learn:
+                self.noise = magnitude if self.noise is None else self.noise + DENOISE_ADAPT * (magnitude - self.noise)
+            if self.noise is not None:
+                clean = np.maximum(magnitude - DENOISE_OVERSUBTRACT * self.noise, DENOISE_FLOOR * magnitude)
+                spectrum *= clean / np.maximum(magnitude, 1e-9)
+            out[i * self.hop:i * self.hop + self.frame] += np.fft.irfft(spectrum, self.frame) * self.window
+        self.pending = x[n * self.hop:]
+        self.tail = out[n * self.hop:]
+        return to_int16(out[:n * self.hop])
+
+class Downmixer:
+    """Turns interleaved multi-channel frames into mono."""
+
+    def __init__(self, channels, mode="average"):
+        self.channels = channels
+        self.mode = mode
+
+    def process(self, samples):
+        frames = samples[:len(samples) - len(samples) % self.channels].reshape(-1, self.channels)
+        if self.mode == "left":
+            return frames[:, 0].copy()
+        if self.mode == "right":
+            return frames[:, 1].copy()
+        return to_int16(frames.mean(axis=1))
+
+class Resampler:
+    """Linear interpolation resampler carrying its position across chunks."""
+
+    def __init__(self, src_rate, dst_rate=RATE):
+        self.step = src_rate / dst_rate
+        self.pos = 0.0  # where the next output sample falls in the pending input
+        self.tail = np.zeros(0)
+
+    def process(self, samples):
+        x = np.concatenate([self.tail, samples.astype(np.float64)])
+        last = len(x) - 1
+        n = int((last - self.pos) // self.step) + 1 if last >= self.pos else 0
+        out = np.interp(self.pos + self.step * np.arange(n), np.arange(len(x)), x)
+        next_pos = self.pos + self.step * n
+        drop = min(int(next_pos), len(x))
+        self.tail = x[drop:]
+        self.pos = next_pos - drop
+        return to_int16(out)
+
+def pcm_to_int16(data, width):
+    """Converts little-endian PCM samples of any whole-byte width to 16-bit."""
+    if width == 1:
+        # 8-bit WAV is the odd one out, unsigned around 128
+        return (np.frombuffer(data, dtype=np.uint8).astype(np.int16) - 128) << 8
+    if width == 2:
+        return bytes_to_int16(data)
+    if width in (3, 4):
+        # keep the top two bytes of each sample, which is the 16-bit value
+        frames = np.frombuffer(data[:len(data) - len(data) % width], dtype=np.uint8).reshape(-1, width)
+        return frames[:, width - 2:].copy().view("<i2").ravel()
+    raise ValueError(f"{width * 8}-bit PCM isn't supported")
+
+def convert_to_int16(sample_format, data):
+    """Converts captured frames in one of SAMPLE_FORMATS to 16-bit samples."""
+    if sample_format == "s16":
+        return bytes_to_int16(data)
+    if sample_format == "s24":
+        return pcm_to_int16(data, 3)
+    if sample_format == "f32":
+        # full scale is ±1.0, but nothing stops a float from going past it
+        return to_int16(np.frombuffer(data[:len(data) - len(data) % 4], dtype="<f4") * 32767)
+    raise ValueError(f"unknown sample format {sample_format}")
+
+def read_wav(f):
+    """Reads an 8, 16, 24 or 32-bit PCM WAV as mono 16-bit samples at RATE."""
+    try:
+        w = wave.open(f, "rb")
+    except wave.Error as e:
+        # the wave module only reads PCM, and gives anything else away by its format tag
+        message = str(e)
+        if message.startswith("unknown format: "):
+            tag = int(message.removeprefix("unknown format: "))
+        elif message.startswith("unknown extended format: "):
+            tag = int(message.removeprefix("unknown extended format: ")[:8], 16)  # the GUID starts with the tag
+        else:
+            raise
+        raise ValueError(f"{WAV_FORMATS.get(tag, f'format {tag}')} WAV isn't supported, convert it to PCM") from None
+    with w:
+        rate, channels = w.getframerate(), w.getnchannels()
+        samples = pcm_to_int16(w.readframes(w.getnframes()), w.getsampwidth())
+    if channels > 1:
+        samples = Downmixer(channels).process(samples)
+    if rate != RATE:
+        samples = Resampler(rate).process(samples)
+    return samples
+
+def write_wav(path, pcm, rate=RATE):
+    with wave.open(str(path), "wb") as f:
+        f.setnchannels(1)
+        f.setsampwidth(2)
+        f.setframerate(rate)
+        f.writeframes(pcm)
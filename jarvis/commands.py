@@ -0,0 +1,73 @@
+"""What decides a transcript is meant for us and what it asks for: the wake
+phrase, and the commands that run without the LLM."""
+
+import logging
+import re
+import time
+
+
+log = logging.getLogger(__name__)
+
+
+class CommandRegistry:
+    """Maps spoken phrases to handlers, checked in registration order.
+
+    Handlers get the regex groups as arguments and may return a reply to
+    print and speak.
+    """
+
+    def __init__(self):
+        self.commands = []
+
+    def exact(self, *phrases):
+        def register(handler):
+            for phrase in phrases:
+                self.commands.append((phrase, None, handler))
+            return handler
+        return register
+
+    def pattern(self, regex):
+        def register(handler):
+            self.commands.append((regex, re.compile(regex), handler))
+            return handler
+        return register
+
+    def match(self, text):
+        normalized = " ".join(text.lower().split())
+        for phrase, compiled, handler in self.commands:
+            if compiled is None:
+                if normalized == phrase:
+                    return handler, ()
+            else:
+                m = compiled.fullmatch(normalized)
+                if m:
+                    return handler, m.groups()
+        return None
+
+class WakeGate:
+    """Drops transcripts unless the wake phrase opened a listening session recently."""
+
+    def __init__(self, phrase, timeout):
+        self.phrase = phrase.lower()
+        # whole words, so "computer" doesn't wake us for "computers"
+        self.pattern = re.compile(rf"\b{re.escape(self.phrase)}\b")
+        self.timeout = timeout
+        self.active_until = 0.0
+
+    def after(self, text) -> str|None:
+        """What's said after the wake phrase, or None if it isn't in text."""
+        match = self.pattern.search(text)
+        return text[match.end():].strip() if match else None
+
+    def filter(self, text) -> str|None:
+        now = time.monotonic()
+        rest = self.after(text)
+        if rest is not None:
+            if now >= self.active_until:
+                log.info("Wake word heard, listening for %gs", self.timeout)
+            self.active_until = now + self.timeout
+            return rest or None
+        if now < self.active_until:
+            self.active_until = now + self.timeout
+            return text
+        return None
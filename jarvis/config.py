@@ -0,0 +1,42 @@
+"""Option defaults from a TOML file, checked like the command line would be."""
+
+import tomllib
+
+
+def load_config(parser, path) -> dict:
+    """Reads path into defaults for parser's options, raising ValueError for
+    a file that can't be read or doesn't fit them."""
+    # keys are option names without the leading dashes, written with - or _,
+    # e.g. vad-metric = "rms" or max_utterance = 20
+    try:
+        with open(path, "rb") as f:
+            data = tomllib.load(f)
+    except (OSError, tomllib.TOMLDecodeError) as e:
+        raise ValueError(f"Can't read config {path}: {e}")
+    actions = {a.dest: a for a in parser._actions if a.dest not in ("help", "config")}
+    config = {}
+    for key, value in data.items():
+        action = actions.get(key.replace("-", "_"))
+        if action is None:
+            raise ValueError(f"{path}: unknown option {key}")
+        if action.nargs == 0:
+            if not isinstance(value, bool):
+                raise ValueError(f"{path}: {key} must be true or false")
+        elif isinstance(value, bool):
+            # an option whose value is optional can be given bare, like
+            # timestamps = true for --timestamps; anything else needs a value
+            if action.nargs != "?":
+                raise ValueError(f"{path}: {key} needs a value, not true or false")
+            value = action.const if value else action.default
+        elif action.type:
+            try:
+                value = action.type(value)
+            except (TypeError, ValueError):
+                raise ValueError(f"{path}: invalid value for {key}: {value!r}")
+        elif not isinstance(value, str):
+            # argparse would have handed these over as the string typed
+            raise ValueError(f"{path}: {key} must be a string, not {value!r}")
+        if action.choices and value not in action.choices:
+            raise ValueError(f"{path}: {key} must be one of {', '.join(action.choices)}")
+        config[action.dest] = value
+    return config
@@ -0,0 +1,126 @@
+"""Chatbot replies from an LLM server, which may be slow, overloaded or
+restarting: Ollama's API or any OpenAI-compatible one."""
+
+import logging
+import threading
+
+import requests
+
+
+log = logging.getLogger(__name__)
+
+
+def post_with_retries(url, payload, headers=None, *, attempts=3, timeout=120, delay=1, stop=None):
+    """POSTs payload as JSON and returns the response, retrying timeouts,
+    connection errors, server errors and 429s up to attempts tries in all.
+    The wait before a retry starts at delay seconds and doubles each time;
+    setting the stop Event cuts it short and gives up."""
+    stop = stop or threading.Event()
+    for attempt in range(1, attempts + 1):
+        try:
+            response = requests.post(url, json=payload, headers=headers, timeout=timeout)
+            response.raise_for_status()
+            return response
+        except requests.RequestException as e:
+            # a bad request or a wrong key fails the same way every time,
+            # but an overloaded or restarting server may come back
+            status = e.response.status_code if e.response is not None else None
+            if status is not None and status < 500 and status != 429 or attempt == attempts:
+                if attempt > 1:
+                    raise requests.RequestException(f"{e} (after {attempt} attempts)") from e
+                raise
+            log.warning("LLM request failed (%s), retrying in %ss", e, delay)
+        # don't hold up shutting down
+        if stop.wait(delay):
+            raise requests.RequestException("gave up retrying, shutting down")
+        delay *= 2
+
+def estimate_tokens(text) -> int:
+    # about four characters a token for English, close enough for a budget
+    return len(text) // 4 + 1
+
+class Conversation:
+    """The exchanges so far, trimmed to the most recent that fit the limits."""
+
+    def __init__(self, max_turns=10, max_tokens=2000):
+        self.max_turns = max_turns
+        self.max_tokens = max_tokens
+        self.turns = []  # (prompt, reply) pairs, oldest first
+        self.lock = threading.Lock()
+
+    def add(self, prompt, reply):
+        with self.lock:
+            self.turns.append((prompt, reply))
+            del self.turns[:max(0, len(self.turns) - self.max_turns)]
+
+    def messages(self, system_prompt, prompt) -> list[dict]:
+        with self.lock:
+            turns = []
+            budget = self.max_tokens
+            for user, assistant in reversed(self.turns):
+                budget -= estimate_tokens(user) + estimate_tokens(assistant)
+                if budget < 0:
+                    break
+                turns.insert(0, (user, assistant))
+        messages = [{"role": "system", "content": system_prompt}]
+        for user, assistant in turns:
+            messages += [{"role": "user", "content": user}, {"role": "assistant", "content": assistant}]
+        return messages + [{"role": "user", "content": prompt}]
+
+    def reset(self):
+        with self.lock:
+            self.turns = []
+
+class Responder:
+    """Turns a prompt into a chatbot reply, keeping the conversation so far.
+    Requests are retried as post_with_retries() does, with its attempts,
+    timeout, delay and stop."""
+
+    def __init__(self, model_name, *, system_prompt, summary_prompt, conversation=None, attempts=3, timeout=120,
+                 delay=1, stop=None):
+        self.model_name = model_name
+        self.system_prompt = system_prompt
+        self.summary_prompt = summary_prompt
+        self.conversation = conversation or Conversation()
+        self.retries = {"attempts": attempts, "timeout": timeout, "delay": delay, "stop": stop}
+
+    def respond(self, user_prompt) -> str:
+        reply = self.complete(self.conversation.messages(self.system_prompt, user_prompt))
+        self.conversation.add(user_prompt, reply)
+        return reply
+
+    def summarize(self, transcript) -> str:
+        # a one-off, kept out of the conversation
+        return self.complete([{"role": "system", "content": self.summary_prompt}, {"role": "user", "content": transcript}])
+
+    def complete(self, messages) -> str:
+        raise NotImplementedError
+
+    def post(self, url, payload, headers=None):
+        """POSTs to the LLM, retrying what might work a second time."""
+        return post_with_retries(url, payload, headers, **self.retries)
+
+    def reset(self):
+        self.conversation.reset()
+
+class OllamaResponder(Responder):
+    def __init__(self, url, model_name, **options):
+        super().__init__(model_name, **options)
+        self.url = url
+
+    def complete(self, messages) -> str:
+        payload = {"model": self.model_name, "messages": messages, "stream": False}
+        return self.post(self.url, payload).json()["message"]["content"]
+
+class OpenAIResponder(Responder):
+    """Any OpenAI-compatible chat completions API (llama.cpp server, vLLM, OpenAI...)."""
+
+    def __init__(self, endpoint, model_name, api_key=None, **options):
+        super().__init__(model_name, **options)
+        self.url = endpoint.rstrip("/") + "/chat/completions"
+        self.api_key = api_key
+
+    def complete(self, messages) -> str:
+        headers = {"Authorization": f"Bearer {self.api_key}"} if self.api_key else {}
+        payload = {"model": self.model_name, "messages": messages}
+        return self.post(self.url, payload, headers).json()["choices"][0]["message"]["content"]
@@ -0,0 +1,54 @@
+"""Counters and histograms for GET /metrics."""
+
+import threading
+
+
+class Metrics:
+    """Counters and latency histograms, rendered in Prometheus' text format."""
+
+    COUNTERS = {
+        "transcriptions_total": "Transcripts handled",
+        "errors_total": "Errors reported",
+        "transcripts_dropped_total": "Transcripts dropped because the worker queue was full",
+        "ws_messages_dropped_total": "Messages a slow WebSocket client missed because its queue was full",
+        "utterances_too_short_total": "Utterances dropped for being shorter than --min-utterance",
+        "clipping_seconds_total": "Seconds of captured audio that clipped",
+        "llm_prompts_skipped_total": "Transcripts not sent to the LLM for being below --llm-min-confidence",
+    }
+    HISTOGRAMS = {
+        "decode_seconds": "Time spent in the recognizer producing each transcript",
+        "latency_seconds": "Time from the end of speech to its transcript being handled",
+    }
+    BUCKETS = (0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1.0, 2.5, 5.0, 10.0)
+
+    def __init__(self):
+        self.lock = threading.Lock()
+        self.counters = dict.fromkeys(self.COUNTERS, 0)
+        # per histogram: bucket counts, then the count and sum of observations
+        self.histograms = {name: [[0] * len(self.BUCKETS), 0, 0.0] for name in self.HISTOGRAMS}
+
+    def inc(self, name, n=1):
+        with self.lock:
+            self.counters[name] += n
+
+    def observe(self, name, seconds):
+        with self.lock:
+            histogram = self.histograms[name]
+            for i, bound in enumerate(self.BUCKETS):
+                if seconds <= bound:
+                    histogram[0][i] += 1
+            histogram[1] += 1
+            histogram[2] += seconds
+
+    def render(self) -> str:
+        with self.lock:
+            lines = []
+            for name, help_text in self.COUNTERS.items():
+                lines += [f"# HELP jarvis_{name} {help_text}", f"# TYPE jarvis_{name} counter", f"jarvis_{name} {self.counters[name]}"]
+            for name, help_text in self.HISTOGRAMS.items():
+                buckets, count, total = self.histograms[name]
+                lines += [f"# HELP jarvis_{name} {help_text}", f"# TYPE jarvis_{name} histogram"]
+                for bound, n in zip(self.BUCKETS, buckets):
+                    lines.append(f'jarvis_{name}_bucket{{le="{bound}"}} {n}')
+                lines += [f'jarvis_{name}_bucket{{le="+Inf"}} {count}', f"jarvis_{name}_sum {total}", f"jarvis_{name}_count {count}"]
+        return "\n".join(lines) + "\n"
@@ -0,0 +1,148 @@
+"""Finding, downloading and checking vosk models."""
+
+import hashlib
+import re
+import shutil
+import sys
+import zipfile
+from pathlib import Path
+
+import requests
+
+
+MODEL_DIR = Path("model")
+MODEL_LIST_URL = "https://alphacephei.com/vosk/models/model-list.json"
+# How the files a vosk model can't do without start: Kaldi's binary header
+# for the acoustic model, OpenFst's magic number for the graphs
+KALDI_MAGIC = b"\0B"
+FST_MAGIC = bytes.fromhex("d6fdb27e")
+
+
+class DownloadError(Exception):
+    """The model list or a model couldn't be fetched."""
+
+
+def resolve_model(name, model_dir=MODEL_DIR) -> Path|None:
+    # accepts a path, a directory name under model_dir, or a bare model name
+    # like "small-en-us-0.15" which resolves to model_dir/vosk-model-small-en-us-0.15
+    candidates = [Path(name), model_dir / name, model_dir / f"vosk-model-{name}"]
+    for path in candidates:
+        if path.is_dir():
+            return path.resolve()
+    return None
+
+def fetch_model_list() -> list[dict]:
+    try:
+        return requests.get(MODEL_LIST_URL, timeout=30).json()
+    except (requests.RequestException, ValueError) as e:
+        raise DownloadError(f"Couldn't fetch the model list from {MODEL_LIST_URL}: {e}")
+
+def download_model(name, models=None, model_dir=MODEL_DIR) -> Path:
+    """Downloads and unpacks a model from the list into model_dir, checking
+    its md5, and returns where it went."""
+    models = models if models is not None else fetch_model_list()
+    entry = next((m for m in models if m["name"] in (name, f"vosk-model-{name}")), None)
+    if entry is None:
+        raise DownloadError(f"No model called {name} in {MODEL_LIST_URL}")
+    model_dir.mkdir(exist_ok=True)
+    # download and unpack next to the final location so an interrupted run
+    # never leaves something that looks like a usable model
+    archive = model_dir / f"{entry['name']}.zip.part"
+    staging = model_dir / f".{entry['name']}.unpack"
+    digest = hashlib.md5()
+    try:
+        try:
+            with requests.get(entry["url"], stream=True, timeout=30) as response:
+                response.raise_for_status()
+                total = int(response.headers.get("Content-Length", 0))
+                done = 0
+                with open(archive, "wb") as f:
+                    for block in response.iter_content(1 << 20):
+                        f.write(block)
+                        digest.update(block)
+                        done += len(block)
+                        if total:
+                            print(f"\rDownloading {entry['name']}: {done * 100 // total}%", end="", file=sys.stderr)
+            print(file=sys.stderr)
+        except requests.RequestException as e:
+            raise DownloadError(f"Downloading {entry['url']} failed: {e}")
+        if entry.get("md5") and digest.hexdigest() != entry["md5"]:
+            raise DownloadError(f"Checksum mismatch for {entry['url']}, try again")
+        shutil.rmtree(staging, ignore_errors=True)
+        with zipfile.ZipFile(archive) as z:
+            z.extractall(staging)
+        target = model_dir / entry["name"]
+        (staging / entry["name"]).rename(target)
+    finally:
+        # whatever stopped us, Ctrl+C and SIGTERM included, the pieces go
+        archive.unlink(missing_ok=True)
+        shutil.rmtree(staging, ignore_errors=True)
+    return target.resolve()
+
+def lang_matches(code, lang) -> bool:
+    # lang is the whole code or its first parts, so "en" takes in en-us and
+    # en-in but "us" doesn't, nor "fa" a model with "fast" in its name
+    lang = lang.lower()
+    return code == lang or code.startswith(lang + "-")
+
+def find_model_for_lang(lang, model_dir=MODEL_DIR) -> Path|None:
+    for path in sorted(model_dir.glob("vosk-model-*")):
+        code = model_language(path)
+        if path.is_dir() and code and lang_matches(code, lang):
+            return path.resolve()
+    return None
+
+def download_model_for_lang(lang, model_dir=MODEL_DIR) -> Path:
+    # the small model, as vosk itself would pick, for the language exactly
+    # if there's one like that
+    models = [m for m in fetch_model_list() if m.get("type") == "small" and m.get("obsolete") != "true"
+              and lang_matches(m.get("lang", ""), lang)]
+    entry = min(models, key=lambda m: m["lang"] != lang.lower(), default=None)
+    if entry is None:
+        raise DownloadError(f"No {lang} model in {MODEL_LIST_URL}")
+    return download_model(entry["name"], models, model_dir)
+
+def model_size(path) -> int:
+    return sum(f.stat().st_size for f in path.rglob("*") if f.is_file())
+
+def model_language(path) -> str|None:
+    # vosk names its models vosk-model-[small-]<language>[-<region>]-<version>
+    lang = re.match(r"vosk-model-(?:small-)?([a-z]{2,3}(?:-[a-z]{2})?)(?=-|$)", path.name)
+    return lang.group(1) if lang else None
+
+def model_info(path) -> dict:
+    """What can be told about a vosk model from its files: the language in
+    its name, the words in its vocabulary, whether its graph is built at
+    runtime (which --vocab-file needs) and the sample rate it expects."""
+    graph = path / "graph" if (path / "graph").is_dir() else path
+    words = graph / "words.txt"
+    mfcc = path / "conf" / "mfcc.conf"
+    rate = re.search(r"--sample-frequency=(\d+)", mfcc.read_text(errors="replace")) if mfcc.is_file() else None
+    return {
+        "language": model_language(path),
+        # one line per word, plus <eps> and the like
+        "words": sum(1 for _ in words.open(encoding="utf-8", errors="replace")) if words.is_file() else None,
+        "runtime_graph": not (graph / "HCLG.fst").is_file(),
+        "rescoring": (path / "rescore").is_dir() or (path / "rnnlm").is_dir(),
+        "rate": int(rate.group(1)) if rate else None,
+    }
+
+def check_model(path):
+    """Raises ValueError if path isn't a whole vosk model, something vosk
+    itself only reports as failing to create one."""
+    def starts_with(f, magic):
+        with open(f, "rb") as fh:
+            return fh.read(len(magic)) == magic
+    # newer models keep their parts in am/ and graph/, older ones at the top
+    am = next((f for f in (path / "am" / "final.mdl", path / "final.mdl") if f.is_file()), None)
+    if am is None:
+        raise ValueError(f"{path} has no am/final.mdl, it doesn't look like a vosk model")
+    graph = path / "graph" if (path / "graph").is_dir() else path
+    # either a whole graph or one put together from two parts at runtime
+    graphs = [graph / "HCLG.fst"] if (graph / "HCLG.fst").is_file() else [graph / "HCLr.fst", graph / "Gr.fst"]
+    if not all(f.is_file() for f in graphs):
+        raise ValueError(f"{path} has no graph/HCLG.fst (or HCLr.fst and Gr.fst), it doesn't look like a vosk model")
+    # an interrupted download or unzip leaves files empty or zeroed; the
+    # acoustic model can be binary or, rarely, text
+    if not (starts_with(am, KALDI_MAGIC) or starts_with(am, b"<")) or not all(starts_with(f, FST_MAGIC) for f in graphs):
+        raise ValueError(f"{path} appears corrupt, delete it and download it again")
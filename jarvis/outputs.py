@@ -0,0 +1,90 @@
+"""Where transcripts, replies and the other messages go: the console, JSON
+lines, WebSocket clients."""
+
+import json
+import logging
+import sys
+import threading
+from datetime import datetime
+
+
+log = logging.getLogger(__name__)
+
+
+class Sink:
+    """Somewhere messages go, each a dict with its "type" and fields."""
+
+    def send(self, message):
+        raise NotImplementedError
+
+    def close(self):
+        pass
+
+class ConsoleSink(Sink):
+    """Transcripts and replies on stdout for a person to read, with the time
+    in strftime format timestamps in front if it's given."""
+
+    def __init__(self, timestamps=None):
+        self.timestamps = timestamps
+
+    def prefix(self) -> str:
+        return datetime.now().strftime(self.timestamps) + " " if self.timestamps else ""
+
+    def send(self, message):
+        if message["type"] == "partial":
+            print(f"\r... {message['text']}", end="", flush=True)
+        elif message["type"] == "transcription":
+            turn = f"[{message['turn']}] " if "turn" in message else ""
+            print(f"\n{self.prefix()}{turn}> ", message["text"])
+        elif message["type"] == "reply":
+            print("\n" + self.prefix() + message["text"] + "\n")
+
+class TextSink(Sink):
+    """Bare transcripts on stdout, for a script to read."""
+
+    def send(self, message):
+        if message["type"] == "transcription":
+            print(message["text"], flush=True)
+
+class JSONLinesSink(Sink):
+    """Every message as a line of JSON, or only those of the given types."""
+
+    def __init__(self, file, types=None):
+        self.file = file
+        self.types = types
+        self.lock = threading.Lock()
+
+    def send(self, message):
+        if self.types is not None and message["type"] not in self.types:
+            return
+        with self.lock:
+            self.file.write(json.dumps(message) + "\n")
+            self.file.flush()
+
+    def close(self):
+        if self.file is not sys.stdout:
+            self.file.close()
+
+class WebSocketSink(Sink):
+    def __init__(self, server):
+        self.server = server
+
+    def send(self, message):
+        self.server.broadcast(json.dumps(message))
+
+class Multiplexer(Sink):
+    """Sends every message to each sink, one failing doesn't stop the rest."""
+
+    def __init__(self, sinks):
+        self.sinks = sinks
+
+    def send(self, message):
+        for sink in self.sinks:
+            try:
+                sink.send(message)
+            except Exception as e:
+                log.warning("Couldn't send to %s: %s", type(sink).__name__, e)
+
+    def close(self):
+        for sink in self.sinks:
+            sink.close()
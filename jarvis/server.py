@@ -0,0 +1,334 @@
+"""The servers clients connect to: a broadcast-only WebSocket server for
+live updates and the HTTP API."""
+
+import base64
+import hashlib
+import http.server
+import io
+import json
+import logging
+import queue
+import socket
+import threading
+import urllib.parse
+import wave
+from dataclasses import asdict
+
+from jarvis.audio import read_wav
+
+
+# What to do when a queue is full: throw away what's been waiting longest,
+# throw away what was about to join it, or wait for room
+QUEUE_POLICIES = ("drop-oldest", "drop-newest", "block")
+
+# Messages buffered per WebSocket client, and what gives when a slow client
+# lets them fill up. Blocking isn't offered, it would stall every client.
+WS_CLIENT_QUEUE = 100
+WS_OVERFLOW = "drop-newest"
+# Largest frame read from a WebSocket client, which only needs to send pings
+# and closes; anything bigger closes the connection as "message too big"
+WS_MAX_FRAME = 65536
+WS_CLOSE_TOO_BIG = 1009
+
+# Largest request bodies the HTTP API reads: a WAV for /transcribe (about
+# 50 minutes of 16 kHz 16-bit mono) and the JSON for /reload
+MAX_UPLOAD_BYTES = 100 * 1024 * 1024
+MAX_JSON_BYTES = 65536
+
+
+log = logging.getLogger(__name__)
+
+
+def enqueue(q, item, policy):
+    """Puts item on q by an overflow policy from QUEUE_POLICIES, returning
+    whatever had to be dropped to make room, if anything."""
+    dropped = None
+    while True:
+        try:
+            q.put(item, block=policy == "block")
+            return dropped
+        except queue.Full:
+            if policy == "drop-newest":
+                return item
+        try:
+            dropped = q.get_nowait()
+        except queue.Empty:
+            pass  # a reader made room for us
+
+def ws_frame(payload, opcode=0x1) -> bytes:
+    header = bytes([0x80 | opcode])
+    n = len(payload)
+    if n < 126:
+        header += bytes([n])
+    elif n < 65536:
+        header += bytes([126]) + n.to_bytes(2, "big")
+    else:
+        header += bytes([127]) + n.to_bytes(8, "big")
+    return header + payload
+
+def recv_exactly(conn, n) -> bytes:
+    data = b""
+    while len(data) < n:
+        chunk = conn.recv(n - len(data))
+        if not chunk:
+            raise ConnectionError("connection closed")
+        data += chunk
+    return data
+
+class WebSocketClient:
+    def __init__(self, conn, size, policy, on_drop=None):
+        self.conn = conn
+        self.queue = queue.Queue(maxsize=size)
+        self.policy = policy
+        self.on_drop = on_drop
+        # both loops write frames, and a frame mustn't start inside another
+        self.write_lock = threading.Lock()
+
+    def send(self, message):
+        # a slow client loses messages rather than stalling the pipeline
+        if enqueue(self.queue, message, self.policy) is not None and self.on_drop:
+            self.on_drop()
+
+    def write_loop(self):
+        while True:
+            message = self.queue.get()
+            if message is None:
+                break
+            try:
+                self.write(ws_frame(message.encode()))
+            except OSError:
+                break
+        self.conn.close()
+
+    def write(self, frame):
+        with self.write_lock:
+            self.conn.sendall(frame)
+
+    def read_loop(self):
+        # clients aren't expected to send anything, this is only here to
+        # answer pings and notice when they go away
+        try:
+            while True:
+                head = recv_exactly(self.conn, 2)
+                opcode, length = head[0] & 0x0f, head[1] & 0x7f
+                if length == 126:
+                    length = int.from_bytes(recv_exactly(self.conn, 2), "big")
+                elif length == 127:
+                    length = int.from_bytes(recv_exactly(self.conn, 8), "big")
+                if length > WS_MAX_FRAME:
+                    self.write(ws_frame(WS_CLOSE_TOO_BIG.to_bytes(2, "big"), 0x8))
+                    break
+                mask = recv_exactly(self.conn, 4) if head[1] & 0x80 else bytes(4)
+                payload = bytes(b ^ mask[i % 4] for i, b in enumerate(recv_exactly(self.conn, length)))
+                if opcode == 0x8:
+                    self.write(ws_frame(b"", 0x8))
+                    break
+                if opcode == 0x9:
+                    self.write(ws_frame(payload, 0xa))
+        except (OSError, ConnectionError):
+            pass
+
+class WebSocketServer:
+    """Broadcast-only WebSocket server, every message goes to every client."""
+
+    GUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+    def __init__(self, host, port, queue_size=WS_CLIENT_QUEUE, overflow=WS_OVERFLOW, on_drop=None):
+        """Each client gets a queue of queue_size messages, overflowing by a
+        policy from QUEUE_POLICIES; on_drop is called for every message lost."""
+        self.queue_size = queue_size
+        self.overflow = overflow
+        self.on_drop = on_drop
+        self.clients = set()
+        self.lock = threading.Lock()
+        self.sock = socket.create_server((host, port))
+        threading.Thread(target=self.accept_loop, daemon=True).start()
+
+    def accept_loop(self):
+        while True:
+            try:
+                conn, _ = self.sock.accept()
+            except OSError:
+                return
+            threading.Thread(target=self.serve, args=(conn,), daemon=True).start()
+
+    def handshake(self, conn) -> bool:
+        request = b""
+        while b"\r\n\r\n" not in request:
+            chunk = conn.recv(1024)
+            if not chunk or len(request) > 65536:
+                return False
+            request += chunk
+        key = None
+        for line in request.decode("latin-1").split("\r\n")[1:]:
+            name, _, value = line.partition(":")
+            if name.strip().lower() == "sec-websocket-key":
+                key = value.strip()
+        if not key:
+            conn.sendall(b"HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\n\r\n")
+            return False
+        accept = base64.b64encode(hashlib.sha1((key + self.GUID).encode()).digest()).decode()
+        conn.sendall(("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"
+                      f"Sec-WebSocket-Accept: {accept}\r\n\r\n").encode())
+        return True
+
+    def serve(self, conn):
+        try:
+            if not self.handshake(conn):
+                conn.close()
+                return
+        except OSError:
+            conn.close()
+            return
+        client = WebSocketClient(conn, self.queue_size, self.overflow, self.on_drop)
+        with self.lock:
+            self.clients.add(client)
+        threading.Thread(target=client.write_loop, daemon=True).start()
+        try:
+            client.read_loop()
+        finally:
+            with self.lock:
+                self.clients.discard(client)
+            # the end marker mustn't wait behind a full queue
+            enqueue(client.queue, None, "drop-oldest")
+
+    def broadcast(self, message):
+        with self.lock:
+            clients = list(self.clients)
+        for client in clients:
+            client.send(message)
+
+    def close(self):
+        self.sock.close()
+
+def parse_addr(value) -> tuple[str, int]:
+    host, _, port = value.rpartition(":")
+    return host or "0.0.0.0", int(port)
+
+class APIHandler(http.server.BaseHTTPRequestHandler):
+    def send_json(self, status, body):
+        payload = json.dumps(body).encode()
+        self.send_response(status)
+        self.send_header("Content-Type", "application/json")
+        self.send_header("Content-Length", str(len(payload)))
+        self.end_headers()
+        self.wfile.write(payload)
+
+    def send_text(self, status, body, content_type="text/plain; charset=utf-8"):
+        payload = body.encode()
+        self.send_response(status)
+        self.send_header("Content-Type", content_type)
+        self.send_header("Content-Length", str(len(payload)))
+        self.end_headers()
+        self.wfile.write(payload)
+
+    def do_GET(self):
+        url = urllib.parse.urlsplit(self.path)
+        if url.path == "/history":
+            n = urllib.parse.parse_qs(url.query).get("n", [None])[0]
+            if n is not None and not n.isdigit():
+                self.send_json(400, {"error": "n must be a whole number"})
+                return
+            self.send_json(200, {"transcripts": self.server.history.recent(None if n is None else int(n))})
+        elif url.path == "/healthz":
+            if self.server.capturing.is_set():
+                self.send_text(200, "OK\n")
+            else:
+                self.send_text(503, "not capturing\n")
+        elif url.path == "/metrics":
+            self.send_text(200, self.server.metrics.render(), "text/plain; version=0.0.4")
+        else:
+            self.send_json(404, {"error": "not found"})
+
+    def do_POST(self):
+        url = urllib.parse.urlsplit(self.path)
+        if url.path == "/reload":
+            self.reload()
+            return
+        if url.path == "/replay":
+            self.replay()
+            return
+        if url.path != "/transcribe":
+            self.send_json(404, {"error": "not found"})
+            return
+        body = self.read_body(MAX_UPLOAD_BYTES)
+        if body is None:
+            return
+        try:
+            samples = read_wav(io.BytesIO(body))
+        except (wave.Error, EOFError, ValueError) as e:
+            self.send_json(400, {"error": f"can't read WAV: {e}"})
+            return
+        segments = self.server.transcribe(samples)
+        self.send_json(200, {"text": " ".join(s.text for s in segments),
+                             "segments": [{k: v for k, v in asdict(s).items() if k not in ("audio", "speech_end", "pitch", "turn")}
+                                          for s in segments]})
+
+    def read_body(self, limit) -> bytes|None:
+        """The request body, or None once an error has been sent instead."""
+        try:
+            length = int(self.headers.get("Content-Length", 0))
+        except ValueError:
+            length = -1
+        if length < 0:
+            self.send_json(400, {"error": "bad Content-Length"})
+            return None
+        if length > limit:
+            # the body is left unread, so the connection can't be reused
+            self.close_connection = True
+            self.send_json(413, {"error": f"request body is over {limit} bytes"})
+            return None
+        return self.rfile.read(length)
+
+    def replay(self):
+        if not self.server.replay:
+            self.send_json(404, {"error": "start with --replay to keep audio for replaying"})
+            return
+        try:
+            text = self.server.replay.play()
+        except OSError as e:
+            self.send_json(500, {"error": f"can't play the audio: {e}"})
+            return
+        if text is None:
+            self.send_json(404, {"error": "nothing to replay yet"})
+        else:
+            self.send_json(200, {"text": text})
+
+    def reload(self):
+        body = self.read_body(MAX_JSON_BYTES)
+        if body is None:
+            return
+        try:
+            name = json.loads(body).get("model") if body else None
+            if name is not None and not isinstance(name, str):
+                raise ValueError(name)
+        except (ValueError, AttributeError):
+            self.send_json(400, {"error": 'expected {"model": "name or path"}'})
+            return
+        try:
+            path = self.server.reloader.reload(name)
+        except FileNotFoundError as e:
+            self.send_json(404, {"error": str(e)})
+            return
+        except Exception as e:
+            self.send_json(500, {"error": f"can't load the model: {e}"})
+            return
+        self.send_json(200, {"model": str(path)})
+
+    def log_message(self, format, *args):
+        log.debug("%s %s", self.address_string(), format % args)
+
+class APIServer(http.server.ThreadingHTTPServer):
+    """The HTTP API, answering from the history and metrics it's given.
+    transcribe turns samples into segments for POST /transcribe, and replay
+    and reloader are a ReplayBuffer and ModelReloader from run.py, replay
+    being None when no audio is kept."""
+
+    def __init__(self, addr, history, metrics, capturing, transcribe, reloader, replay=None):
+        super().__init__(addr, APIHandler)
+        self.history = history
+        self.metrics = metrics
+        self.capturing = capturing  # an Event, set while audio is coming in
+        self.transcribe = transcribe
+        self.reloader = reloader
+        self.replay = replay
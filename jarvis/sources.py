@@ -0,0 +1,248 @@
+"""Where the audio comes from: a capture device or a recording."""
+
+import logging
+import threading
+import time
+from collections import deque
+
+import pyaudio
+
+from jarvis.audio import CHUNK, RATE, Downmixer, Resampler, convert_to_int16, int16_to_bytes, read_wav
+
+
+# PyAudio's names for the audio.SAMPLE_FORMATS
+PA_FORMATS = {"s16": pyaudio.paInt16, "s24": pyaudio.paInt24, "f32": pyaudio.paFloat32}
+FORMAT_NAMES = {"s16": "16-bit", "s24": "24-bit", "f32": "32-bit float"}
+
+
+log = logging.getLogger(__name__)
+
+
+class AudioSource:
+    """Where audio comes from.
+
+    read() returns the next chunk of 16-bit mono PCM at RATE, raising EOFError
+    when there's no more and OSError when the device fails.
+    """
+
+    def read(self) -> bytes:
+        raise NotImplementedError
+
+    def reconnect(self, stop):
+        """Tries to get audio flowing again after read() failed, until stop is set."""
+        raise OSError("this source can't reconnect")
+
+    def close(self):
+        pass
+
+class MicrophoneSource(AudioSource):
+    """Captures from a PyAudio input device, mixing down and resampling to
+    mono RATE and converting to 16-bit. rate=None captures at the device's
+    default rate, and chunk is in samples at RATE."""
+
+    def __init__(self, device=None, rate=RATE, channels=1, mono_mix="average", stall_timeout=None, max_delay=30,
+                 chunk=CHUNK, sample_format="s16"):
+        self.device = device
+        self.channels = channels
+        self.sample_format = sample_format
+        self.stall_timeout = stall_timeout
+        self.max_delay = max_delay
+        self.p = pyaudio.PyAudio()
+        try:
+            info = self.p.get_device_info_by_index(device) if device is not None else self.p.get_default_input_device_info()
+        except OSError:
+            self.p.terminate()
+            raise OSError("no capture device found")
+        # indexes shift as devices come and go, so a replugged one is found
+        # again by its name
+        self.device_name = info["name"] if device is not None else None
+        native = int(info["defaultSampleRate"])
+        if rate is None:
+            rate = native
+        elif rate != native and not self.supports(info["index"], rate, channels):
+            # some backends would rather open at another rate than refuse, so
+            # ask first and resample from one the device is happy with
+            log.warning("%s can't capture %s at %d Hz, capturing at %d Hz and resampling", info["name"], FORMAT_NAMES[sample_format], rate, native)
+            rate = native
+        self.rate = rate
+        # read the same duration of audio per chunk whatever the capture rate
+        self.chunk = chunk * rate // RATE
+        self.filters = []
+        if channels > 1:
+            self.filters.append(Downmixer(channels, mono_mix))
+        if rate != RATE:
+            self.filters.append(Resampler(rate))
+        try:
+            self.stream = self.open()
+        except OSError as e:
+            self.p.terminate()
+            raise OSError(f"{info['name']} won't capture {channels} channel(s) of {FORMAT_NAMES[sample_format]} audio "
+                          f"at {rate} Hz: {e}")
+        log.info("Capturing from %s: %d channel(s) of %s audio at %d Hz%s, %.0f ms input latency", info["name"], channels,
+                 FORMAT_NAMES[sample_format], rate, f" resampled to {RATE} Hz" if rate != RATE else "",
+                 self.stream.get_input_latency() * 1000)
+
+    def supports(self, index, rate, channels) -> bool:
+        try:
+            return self.p.is_format_supported(rate, input_device=index, input_channels=channels,
+                                              input_format=PA_FORMATS[self.sample_format])
+        except ValueError:
+            return False
+
+    def open(self):
+        return self.p.open(format=PA_FORMATS[self.sample_format], channels=self.channels, rate=self.rate, input=True,
+                           frames_per_buffer=self.chunk, input_device_index=self.device)
+
+    def read(self) -> bytes:
+        if self.stall_timeout:
+            # an unplugged device can leave a blocking read hanging forever, so
+            # wait for the audio ourselves and give up if none arrives
+            deadline = time.monotonic() + self.stall_timeout
+            while self.stream.get_read_available() < self.chunk:
+                if time.monotonic() > deadline:
+                    raise OSError(f"no audio for {self.stall_timeout}s")
+                time.sleep(0.01)
+        data = self.stream.read(self.chunk, exception_on_overflow=False)
+        if not self.filters and self.sample_format == "s16":
+            return data
+        samples = convert_to_int16(self.sample_format, data)
+        for f in self.filters:
+            samples = f.process(samples)
+        return int16_to_bytes(samples)
+
+    def reconnect(self, stop):
+        self.close()
+        delay = 1
+        while not stop.wait(delay):
+            # a fresh PyAudio rescans the devices, so a replugged one shows up again
+            self.p = pyaudio.PyAudio()
+            try:
+                if self.device_name is not None:
+                    self.device = self.find_device(self.device_name)
+                self.stream = self.open()
+                log.info("Capture device reopened")
+                return
+            except OSError as e:
+                self.p.terminate()
+                delay = min(delay * 2, self.max_delay)
+                log.warning("Couldn't reopen the capture device (%s), retrying in %ss", e, delay)
+
+    def find_device(self, name) -> int:
+        for i in range(self.p.get_device_count()):
+            info = self.p.get_device_info_by_index(i)
+            if info["name"] == name and info["maxInputChannels"] > 0:
+                return i
+        raise OSError(f"{name} isn't plugged in")
+
+    def close(self):
+        try:
+            self.stream.stop_stream()
+            self.stream.close()
+        except OSError:
+            pass  # the device may already be gone
+        self.p.terminate()
+
+class ThreadedSource(AudioSource):
+    """Reads another source on a thread of its own, queueing up to max_chunks
+    chunks, so a slow decode doesn't leave the device's buffer to overflow.
+    Past that the oldest audio is dropped."""
+
+    def __init__(self, source, max_chunks):
+        self.source = source
+        self.chunks = deque(maxlen=max_chunks)
+        self.ready = threading.Condition()
+        self.stopped = threading.Event()
+        # set by reconnect() once the source is back
+        self.reconnected = threading.Event()
+        self.overflowing = False
+        # the one reader for good: a thread started later by whoever calls
+        # reconnect() would inherit the recognition thread's lower priority
+        self.thread = threading.Thread(target=self.run, daemon=True)
+        self.thread.start()
+
+    def run(self):
+        while not self.stopped.is_set():
+            try:
+                item = self.source.read()
+            except EOFError as e:
+                self.put(e)
+                return
+            except OSError as e:
+                # handed over for read() to raise, then wait for the source to
+                # be reopened
+                self.put(e)
+                self.reconnected.wait()
+                self.reconnected.clear()
+                continue
+            except Exception as e:
+                item = e  # a bad chunk, the source itself is still fine
+            self.put(item)
+
+    def put(self, item):
+        with self.ready:
+            full = len(self.chunks) == self.chunks.maxlen
+            if full and not self.overflowing:
+                log.warning("Recognition is more than %d chunks behind capture, dropping audio", self.chunks.maxlen)
+            self.overflowing = full
+            self.chunks.append(item)  # pushing out the oldest when full
+            self.ready.notify()
+
+    def read(self) -> bytes:
+        with self.ready:
+            self.ready.wait_for(lambda: self.chunks)
+            item = self.chunks.popleft()
+        if isinstance(item, Exception):
+            raise item
+        return item
+
+    def reconnect(self, stop):
+        try:
+            self.source.reconnect(stop)
+        finally:
+            self.reconnected.set()
+
+    def close(self):
+        self.stopped.set()
+        self.reconnected.set()
+        # a read finishes within a chunk unless the device hung, and then
+        # closing it is what gets the read to return
+        self.thread.join(1)
+        self.source.close()
+
+class PipeAudioSource(AudioSource):
+    """Reads raw 16-bit mono PCM at RATE from a binary stream, like stdin,
+    as fast as it's written. chunk is in samples."""
+
+    def __init__(self, stream, chunk=CHUNK):
+        self.stream = stream
+        self.chunk = chunk
+
+    def read(self) -> bytes:
+        # blocks until a whole chunk is in, only the last one can be short
+        data = self.stream.read(self.chunk * 2)
+        if len(data) < 2:
+            raise EOFError
+        # a stream cut off mid-sample leaves a byte no sample can be made of
+        return data[:-1] if len(data) % 2 else data
+
+class FileAudioSource(AudioSource):
+    """Replays a WAV file, paced like a live microphone."""
+
+    def __init__(self, path, chunk=CHUNK):
+        with open(path, "rb") as f:
+            self.samples = read_wav(f)
+        self.chunk = chunk
+        self.pos = 0
+        self.next_time = time.monotonic()
+        log.info("Reading %s (%.1fs)", path, len(self.samples) / RATE)
+
+    def read(self) -> bytes:
+        if self.pos >= len(self.samples):
+            raise EOFError
+        chunk = self.samples[self.pos:self.pos + self.chunk]
+        self.pos += self.chunk
+        self.next_time += len(chunk) / RATE
+        delay = self.next_time - time.monotonic()
+        if delay > 0:
+            time.sleep(delay)
+        return int16_to_bytes(chunk)
@@ -0,0 +1,48 @@
+"""Tidying up transcripts for people to read. Vosk gives lowercase words
+with no punctuation, which is what matching commands wants but not what a
+display or an LLM prompt does."""
+
+import re
+
+
+class TextProcessor:
+    """One rule for tidying a transcript. process() returns the new text."""
+
+    def process(self, text) -> str:
+        raise NotImplementedError
+
+class Strip(TextProcessor):
+    """Trims the ends and collapses runs of whitespace to one space."""
+
+    def process(self, text) -> str:
+        return " ".join(text.split())
+
+class Capitalize(TextProcessor):
+    """Capitalizes the first letter of the text and of every sentence in it."""
+
+    SENTENCE_START = re.compile(r"(^|[.!?]\s+)([^\W\d_])")
+
+    def process(self, text) -> str:
+        return self.SENTENCE_START.sub(lambda m: m.group(1) + m.group(2).upper(), text)
+
+class EndPunctuation(TextProcessor):
+    """Ends the text with a full stop unless it already ends in punctuation."""
+
+    def __init__(self, mark="."):
+        self.mark = mark
+
+    def process(self, text) -> str:
+        if not text or text[-1] in ".!?,;:…":
+            return text
+        return text + self.mark
+
+class TextChain(TextProcessor):
+    """Runs text through processors in order."""
+
+    def __init__(self, processors=()):
+        self.processors = list(processors)
+
+    def process(self, text) -> str:
+        for p in self.processors:
+            text = p.process(text)
+        return text
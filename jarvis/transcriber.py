@@ -0,0 +1,545 @@
+"""Turns a stream of audio into transcript segments."""
+
+import json
+import logging
+import math
+import os
+import queue
+import statistics
+import sys
+import threading
+import time
+from collections import deque
+from dataclasses import dataclass, field
+
+import numpy as np
+from vosk import KaldiRecognizer
+
+from jarvis.audio import CHUNK, RATE, bytes_to_int16, estimate_pitch, int16_to_bytes, peak_level
+
+
+log = logging.getLogger(__name__)
+
+# Utterances in a row the recognizer finds no words in before that's reported
+EMPTY_RESULT_LIMIT = 5
+
+# Times recognition may fail and be restarted without an utterance getting
+# through in between, before the failure is taken as permanent
+RESTART_LIMIT = 5
+
+# A new speaker turn starts when an utterance's pitch is this much higher or
+# lower than the one before's, or its level this many times louder or quieter
+TURN_PITCH_CHANGE = 0.15
+TURN_LEVEL_CHANGE = 3.0
+
+
+def lower_priority(nice):
+    """Lowers the calling thread's priority by nice, where the platform can
+    do that for just one thread."""
+    if sys.platform != "linux":
+        # elsewhere this would slow down the whole process, capture included
+        log.warning("Can't lower the priority of one thread on %s, leaving it as it is", sys.platform)
+        return
+    thread = threading.get_native_id()
+    try:
+        os.setpriority(os.PRIO_PROCESS, thread, os.getpriority(os.PRIO_PROCESS, thread) + nice)
+    except OSError as e:
+        log.warning("Couldn't lower the recognition thread's priority: %s", e)
+
+@dataclass
+class Word:
+    word: str
+    start: float  # seconds since the session started
+    end: float
+    confidence: float
+
+@dataclass
+class Segment:
+    text: str
+    start: float  # seconds since the session started
+    end: float
+    level: float  # loudest chunk, same scale as the VAD threshold
+    confidence: float|None = None  # mean of vosk's per-word confidence, 0-1
+    words: list[Word] = field(default_factory=list)  # only filled with words=True
+    decode_time: float = 0.0  # seconds spent in the recognizer finishing it
+    speech_end: float|None = None  # time.monotonic() of the last chunk above the VAD threshold, if any was
+    audio: bytes = field(default=b"", repr=False)  # only filled with keep_audio=True
+    pitch: float|None = None  # median Hz of the voiced chunks, only with pitch=True
+    turn: int|None = None  # set by a TurnTracker
+
+class TurnTracker:
+    """Numbers speaker turns from 1, guessing at a change of speaker from
+    each segment's pitch and level. A guess, not diarization."""
+
+    def __init__(self, pitch_change=TURN_PITCH_CHANGE, level_change=TURN_LEVEL_CHANGE):
+        self.pitch_change = math.log(1 + pitch_change)
+        self.level_change = math.log(level_change)
+        self.turn = 1
+        self.pitch = None
+        self.level = None
+
+    def update(self, segment) -> int:
+        """Sets the next segment's turn and returns it."""
+        segment.turn = self.turn
+        if segment.pitch is None:
+            return self.turn  # nothing to go on, stick with the current turn
+        if self.pitch is not None and (abs(math.log(segment.pitch / self.pitch)) > self.pitch_change or
+                                       abs(math.log(max(segment.level, 1) / max(self.level, 1))) > self.level_change):
+            self.turn += 1
+            segment.turn = self.turn
+        self.pitch = segment.pitch
+        self.level = segment.level
+        return self.turn
+
+class Transcriber:
+    """Runs audio from a source through the filters, the VAD and a Vosk
+    recognizer on a thread of its own.
+
+    start() returns an iterator of Segments that ends when the source runs
+    out or close() is called, re-raising whatever stopped the capture.
+    """
+
+    def __init__(self, model, vad, *, vocab=None, level=peak_level, clip_detector=None, filters=(), denoiser=None,
+                 gate=None, emphasis=None, pre_roll=0, max_utterance=30, min_utterance=None, calibrator=None,
+                 min_level=None, min_confidence=None, ignored_phrases=(), words=False, pitch=False, keep_audio=False,
+                 reconnect=False, muted=None, barge_in_level=None, on_barge_in=None, on_audio=None, on_level=None,
+                 on_partial=None, on_warning=None, on_too_short=None, on_speech_start=None, on_speech_end=None,
+                 on_clipping=None, on_chunk=None, nice=0):
+        self.model = model
+        self.vad = vad
+        self.vocab = vocab
+        self.level = level
+        # sees the audio as captured, before any filter, and calls on_clipping
+        self.clip_detector = clip_detector
+        self.filters = list(filters)
+        # applied after the level is taken, so they shape what the recognizer
+        # hears without moving the VAD's decision
+        self.denoiser = denoiser
+        self.gate = gate
+        self.emphasis = emphasis
+        # chunks from before the VAD triggered that are still fed to the
+        # recognizer, at least the ones it took to trigger
+        self.pre_roll = pre_roll
+        self.max_utterance = max_utterance
+        # seconds of audio above the VAD threshold an utterance needs, so a
+        # click or a plosive doesn't come out as a word
+        self.min_utterance = min_utterance
+        self.min_level = min_level
+        self.min_confidence = min_confidence
+        self.ignored_phrases = set(ignored_phrases)
+        self.words = words
+        self.pitch = pitch
+        self.keep_audio = keep_audio
+        self.reconnect = reconnect
+        self.on_audio = on_audio
+        self.on_level = on_level
+        # every chunk the VAD sees, after the filters, with whether it's speech
+        self.on_chunk = on_chunk
+        self.on_partial = on_partial
+        self.on_warning = on_warning or log.warning
+        self.on_too_short = on_too_short
+        # called from the capture thread as the VAD hears speech start, with
+        # its session time, and stop, with the start and the end of the sound
+        self.on_speech_start = on_speech_start
+        self.on_speech_end = on_speech_end
+        self.on_clipping = on_clipping
+        # lowers the recognition thread's priority by this much, for when the
+        # source reads on a thread of its own
+        self.nice = nice
+        self.calibrator = calibrator
+        self.empty_results = 0
+        self.restarts = 0
+        # set while audio should be thrown away: muted by whoever is speaking,
+        # paused by the user
+        self.muted = muted or threading.Event()
+        # while muted, this loud for the VAD's onset calls on_barge_in so
+        # the speaker can be cut off
+        self.barge_in_level = barge_in_level
+        self.on_barge_in = on_barge_in
+        self.barge_in_frames = 0
+        self.paused = threading.Event()
+        # set while the source is delivering audio
+        self.capturing = threading.Event()
+        self.stopping = threading.Event()
+        # set by set_model() until capture has moved over to the new model
+        self.model_changed = threading.Event()
+        # time.time() of the session's first sample, all session times count from it
+        self.started = None
+        # samples read since then, kept for when capture is restarted
+        self.captured = 0
+        self.results = queue.Queue()
+        self.error = None
+        self.thread = None
+
+    def new_recognizer(self):
+        # the model is shared and safe to use from several threads, recognizers
+        # aren't, so every user gets its own
+        if self.vocab:
+            recognizer = KaldiRecognizer(self.model, RATE, self.vocab)
+        else:
+            recognizer = KaldiRecognizer(self.model, RATE)
+        # per-word results are where the confidence scores come from
+        recognizer.SetWords(True)
+        return recognizer
+
+    def make_segment(self, result, start, end, level, offset=0.0) -> Segment|None:
+        # offset turns vosk's word times, which count only the audio fed to the
+        # recognizer, into session times
+        text = result.get("text")
+        if not text:
+            return None
+        if text in self.ignored_phrases:
+            log.debug("Ignored %r", text)
+            return None
+        if self.min_level and level < self.min_level:
+            log.debug("Dropped %r, level %.0f is below %.0f", text, level, self.min_level)
+            return None
+        words = result.get("result") or []
+        confidence = sum(w["conf"] for w in words) / len(words) if words else None
+        if self.min_confidence and confidence is not None and confidence < self.min_confidence:
+            log.info("Dropped %r, confidence %.2f is below %.2f", text, confidence, self.min_confidence)
+            return None
+        if self.words:
+            # vosk works in whole words, so unlike token-based models there's
+            # nothing to stitch together here
+            words = [Word(w["word"], w["start"] + offset, w["end"] + offset, w["conf"]) for w in words]
+        else:
+            words = []
+        return Segment(text, start, end, level, confidence, words)
+
+    def transcribe(self, samples) -> list[Segment]:
+        """Transcribes a whole recording at once, without the VAD or filters."""
+        recognizer = self.new_recognizer()
+        segments = []
+        start = level = decode_time = 0.0
+        for i in range(0, len(samples), CHUNK):
+            chunk = samples[i:i + CHUNK]
+            level = max(level, self.level(chunk))
+            decode_start = time.perf_counter()
+            done = recognizer.AcceptWaveform(int16_to_bytes(chunk))
+            decode_time += time.perf_counter() - decode_start
+            if done:
+                end = (i + len(chunk)) / RATE
+                segment = self.make_segment(json.loads(recognizer.Result()), start, end, level)
+                if segment:
+                    segment.decode_time = decode_time
+                    segments.append(segment)
+                start, level, decode_time = end, 0.0, 0.0
+        decode_start = time.perf_counter()
+        segment = self.make_segment(json.loads(recognizer.FinalResult()), start, len(samples) / RATE, level)
+        if segment:
+            segment.decode_time = decode_time + time.perf_counter() - decode_start
+            segments.append(segment)
+        return segments
+
+    def start(self, source):
+        self.thread = threading.Thread(target=self.run, args=(source,), daemon=True)
+        self.thread.start()
+        return self
+
+    def stop(self):
+        """Asks the capture to finish, without waiting for it."""
+        self.stopping.set()
+
+    def set_model(self, model):
+        """Switches to another model between chunks, the utterance in progress
+        still finishing with the old one. transcribe() calls already running
+        carry on with the model they started with."""
+        self.model = model
+        self.model_changed.set()
+
+    def close(self):
+        """Stops the capture, flushing the utterance in progress into the results."""
+        self.stop()
+        if self.thread:
+            self.thread.join()
+
+    def wall_time(self, seconds) -> float:
+        """The time.time() at which a session time, like Segment.start, was captured."""
+        return self.started + seconds
+
+    def __iter__(self):
+        return self
+
+    def __next__(self) -> Segment:
+        segment = self.results.get()
+        if segment is None:
+            # leave the end marker for anyone iterating after us
+            self.results.put(None)
+            error, self.error = self.error, None
+            if error:
+                raise error
+            raise StopIteration
+        return segment
+
+    def run(self, source):
+        if self.nice:
+            lower_priority(self.nice)
+        try:
+            while True:
+                try:
+                    self.capture(source)
+                    if self.stopping.is_set() or not self.model_changed.is_set():
+                        break
+                    self.model_changed.clear()
+                    log.info("Switched to the new model")
+                except OSError:
+                    raise  # the source is gone, that's what --reconnect is for
+                except Exception as e:
+                    # a bad chunk or a recognizer error shouldn't end the
+                    # session, start over with a fresh recognizer
+                    self.restarts += 1
+                    if self.restarts > RESTART_LIMIT:
+                        raise
+                    log.debug("Recognition failed", exc_info=True)
+                    self.on_warning(f"Recognition failed ({e!r}), restarting it")
+                    self.vad.reset()
+        except Exception as e:
+            self.error = e
+        finally:
+            self.capturing.clear()
+            source.close()
+            self.results.put(None)
+
+    def capture(self, source):
+        rec = self.new_recognizer()
+        vad = self.vad
+        captured = self.captured
+        fed = 0  # samples given to the recognizer, which is all its word times count
+        offset = 0.0  # session time minus recognizer time for the current run of speech
+        segment_start = 0.0
+        utterance_start = 0.0  # unlike segment_start, not moved on by vosk endpointing
+        last_voiced = 0.0  # session time the last chunk above the threshold ended
+        segment_level = 0.0
+        decode_time = 0.0
+        speech_end = None
+        voiced = 0  # samples above the threshold in the current segment
+        segment_audio = bytearray()  # only filled with keep_audio
+        pitches = []  # only filled with pitch
+        # chunks heard while the VAD is deciding whether speech started, so the
+        # onset of an utterance is still fed to the recognizer
+        onset = deque(maxlen=max(vad.enter_frames, self.pre_roll))
+        was_muted = False
+        was_paused = False
+        last_partial = None
+        # a new model waits for the utterance in progress to finish with this one
+        while not self.stopping.is_set() and not (self.model_changed.is_set() and not vad.is_speaking()):
+            self.captured = captured
+            try:
+                data = source.read()
+            except EOFError:
+                break
+            except OSError as e:
+                if not self.reconnect:
+                    raise
+                self.capturing.clear()
+                log.warning("Lost the capture device (%s), reconnecting", e)
+                source.reconnect(self.stopping)
+                # nothing from before the dropout should be transcribed
+                rec.FinalResult()
+                if vad.is_speaking():
+                    self.speech_ended(utterance_start, last_voiced)
+                vad.reset()
+                onset.clear()
+                segment_audio.clear()
+                # session times are counted in samples, skip them over the
+                # gap so they keep matching the clock
+                if self.started is not None:
+                    captured = max(captured, round((time.time() - self.started) * RATE))
+                continue
+            if not data:
+                continue
+            if self.started is None:
+                self.started = time.time() - len(data) // 2 / RATE
+            self.capturing.set()
+            if self.on_audio:
+                self.on_audio(data)
+            if self.paused.is_set() != was_paused:
+                was_paused = self.paused.is_set()
+                log.info("Paused" if was_paused else "Resumed")
+            if self.muted.is_set() or self.paused.is_set():
+                captured += len(data) // 2
+                if self.on_barge_in and not self.paused.is_set():
+                    self.check_barge_in(data)
+                was_muted = True
+                continue
+            self.barge_in_frames = 0
+            if was_muted:
+                # drop whatever the recognizer caught of our own voice, or from
+                # before a pause
+                rec.FinalResult()
+                if vad.is_speaking():
+                    self.speech_ended(utterance_start, last_voiced)
+                vad.reset()
+                onset.clear()
+                segment_audio.clear()
+                was_muted = False
+            audio_data = bytes_to_int16(data)
+            if self.clip_detector and self.clip_detector.update(audio_data) and self.on_clipping:
+                self.on_clipping()
+            if self.filters:
+                audio_data = self.apply_filters(audio_data)
+                if not len(audio_data):
+                    continue  # held back by a filter looking ahead
+                data = int16_to_bytes(audio_data)
+            amp = self.level(audio_data)
+            captured += len(audio_data)
+            if self.calibrator and not self.calibrator.update(amp, vad.is_speaking()):
+                continue
+            was_speaking = vad.is_speaking()
+            vad.update(amp)
+            if self.on_level:
+                self.on_level(amp, vad.is_speaking())
+            if self.on_chunk:
+                self.on_chunk(audio_data, vad.is_speaking())
+            # the noise is learned from the quiet, not from the start of an
+            # utterance the VAD hasn't caught up with yet
+            audio_data = self.shape(audio_data, learn=amp < vad.threshold and not vad.is_speaking())
+            if self.denoiser or self.gate or self.emphasis:
+                data = int16_to_bytes(audio_data)
+            result = None
+            if vad.is_speaking():
+                if not was_speaking:
+                    segment_start = (captured - len(audio_data)) / RATE
+                    onset_start = fed
+                    for chunk in onset:
+                        rec.AcceptWaveform(chunk)
+                        fed += len(chunk) // 2
+                        segment_start -= len(chunk) // 2 / RATE
+                        if self.keep_audio:
+                            segment_audio += chunk
+                    onset.clear()
+                    offset = segment_start - onset_start / RATE
+                    utterance_start = segment_start
+                    last_voiced = captured / RATE
+                    if self.on_speech_start:
+                        self.on_speech_start(segment_start)
+                    # the VAD only starts after enter_frames loud chunks in a
+                    # row, this one and the ones before it in the onset
+                    voiced = (vad.enter_frames - 1) * len(audio_data)
+                segment_level = max(segment_level, amp)
+                if amp >= vad.threshold:
+                    speech_end = time.monotonic()
+                    last_voiced = captured / RATE
+                    voiced += len(audio_data)
+                    if self.pitch:
+                        pitch = estimate_pitch(audio_data)
+                        if pitch:
+                            pitches.append(pitch)
+                if self.keep_audio:
+                    segment_audio += data
+                decode_start = time.perf_counter()
+                fed += len(audio_data)
+                if rec.AcceptWaveform(data):
+                    result = json.loads(rec.Result())
+                elif captured / RATE - segment_start >= self.max_utterance:
+                    # continuous talking never reaches an endpoint, cut it here
+                    result = json.loads(rec.FinalResult())
+                elif self.on_partial:
+                    partial = json.loads(rec.PartialResult()).get("partial")
+                    if partial and partial != last_partial:
+                        self.on_partial(partial, segment_start)
+                    last_partial = partial
+                decode_time += time.perf_counter() - decode_start
+            elif was_speaking:
+                self.speech_ended(utterance_start, last_voiced)
+                # hangover elapsed, flush whatever the recognizer still holds
+                decode_start = time.perf_counter()
+                result = json.loads(rec.FinalResult())
+                decode_time += time.perf_counter() - decode_start
+            else:
+                onset.append(data)
+
+            if result:
+                last_partial = None
+                self.finish(result, segment_start, captured / RATE, segment_level, offset, decode_time, speech_end, voiced,
+                            segment_audio, pitches)
+                # vosk can endpoint more than once per run of speech
+                segment_start = captured / RATE
+                segment_level = 0.0
+                voiced = 0
+                decode_time = 0.0
+                speech_end = None
+                segment_audio.clear()
+                pitches.clear()
+
+        # a new model carries on with the filters as they are, otherwise this
+        # is the end of the audio and whatever they hold back is due
+        tail = None
+        if self.filters and (self.stopping.is_set() or not self.model_changed.is_set()):
+            tail = self.apply_filters(np.zeros(0, dtype=np.int16), flush=True)
+        if vad.is_speaking():
+            # don't lose the utterance that was in progress, whether we were
+            # stopped or the source ran out
+            decode_start = time.perf_counter()
+            done = False
+            if tail is not None and len(tail):
+                data = int16_to_bytes(self.shape(tail))
+                captured += len(tail)
+                if self.keep_audio:
+                    segment_audio += data
+                done = rec.AcceptWaveform(data)
+            result = json.loads(rec.Result() if done else rec.FinalResult())
+            decode_time += time.perf_counter() - decode_start
+            self.speech_ended(utterance_start, last_voiced)
+            self.finish(result, segment_start, captured / RATE, segment_level, offset, decode_time, speech_end, voiced,
+                        segment_audio, pitches)
+            vad.reset()
+        self.captured = captured
+
+    def apply_filters(self, samples, flush=False):
+        # a filter looking ahead may hold back a whole chunk, the ones after
+        # it mustn't see it empty
+        for f in self.filters:
+            if len(samples):
+                samples = f.process(samples)
+            if flush and hasattr(f, "flush"):
+                samples = np.concatenate([samples, f.flush()])
+        return samples
+
+    def shape(self, samples, learn=False):
+        # applied after the level is taken, see __init__
+        if self.denoiser:
+            samples = self.denoiser.process(samples, learn=learn)
+        if self.gate:
+            samples = self.gate.process(samples)
+        if self.emphasis:
+            samples = self.emphasis.process(samples)
+        return samples
+
+    def speech_ended(self, start, end):
+        if self.on_speech_end:
+            self.on_speech_end(start, end)
+
+    def check_barge_in(self, data):
+        if self.level(bytes_to_int16(data)) < self.barge_in_level:
+            self.barge_in_frames = 0
+            return
+        self.barge_in_frames += 1
+        if self.barge_in_frames == self.vad.enter_frames:
+            log.info("Heard speech over our own, interrupting")
+            self.on_barge_in()
+
+    def finish(self, result, start, end, level, offset, decode_time, speech_end, voiced, audio, pitches):
+        if self.min_utterance and voiced / RATE < self.min_utterance:
+            log.debug("Dropped %r, only %.2fs of it was above the threshold", result.get("text"), voiced / RATE)
+            if self.on_too_short:
+                self.on_too_short()
+            return
+        # loud enough for the VAD but nothing recognized, over and over, is
+        # more likely a broken model or garbled audio than mumbling
+        if result.get("text"):
+            self.empty_results = 0
+        else:
+            self.empty_results += 1
+            if self.empty_results == EMPTY_RESULT_LIMIT:
+                self.on_warning(f"No words recognized in the last {EMPTY_RESULT_LIMIT} utterances, "
+                                "check the model matches the language and the audio isn't garbled (try --keep-audio)")
+        segment = self.make_segment(result, start, end, level, offset)
+        self.restarts = 0
+        if segment:
+            segment.decode_time = decode_time
+            segment.speech_end = speech_end
+            segment.audio = bytes(audio)
+            segment.pitch = statistics.median(pitches) if pitches else None
+            self.results.put(segment)
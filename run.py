@@ -1,37 +1,875 @@
+import argparse
+import csv
 import json
+import logging
+import math
+import os
+import queue
+import re
+import shutil
+import signal
+import sys
+import threading
+import time
+import wave
+from collections import deque
+from dataclasses import asdict, replace
+from datetime import datetime
 from pathlib import Path
 
 import pyaudio
 import requests
 import subprocess
-import numpy as np
 import pyttsx3 as tts
 from thefuzz import fuzz
-from vosk import Model, KaldiRecognizer
+from vosk import Model
 
+from jarvis import (AGC, CHUNK, RATE, SAMPLE_FORMATS, Calibrator, Capitalize, ClipDetector, EndPunctuation,
+                    FileAudioSource, HighPassFilter, LevelMeter, MicrophoneSource, NoiseGate, PipeAudioSource, PreEmphasis,
+                    PushToTalk, SpectralDenoiser, Strip, TextChain, ThreadedSource, Transcriber, TransientSuppressor,
+                    TurnTracker, VoiceActivityDetector, bytes_to_int16, mean_abs_level, peak_level, read_wav, rms_level, write_wav)
+from jarvis.commands import CommandRegistry, WakeGate
+from jarvis.config import load_config
+from jarvis.llm import Conversation, OllamaResponder, OpenAIResponder, estimate_tokens
+from jarvis.metrics import Metrics
+from jarvis.models import (MODEL_DIR, DownloadError, check_model, download_model, download_model_for_lang,
+                           find_model_for_lang, model_info, model_language, model_size, resolve_model)
+from jarvis.outputs import ConsoleSink, JSONLinesSink, Multiplexer, TextSink, WebSocketSink
+from jarvis.server import (QUEUE_POLICIES, WS_CLIENT_QUEUE, WS_OVERFLOW, APIServer, WebSocketServer, enqueue,
+                           parse_addr)
+
+
+# Model settings
+DEFAULT_MODEL = "vosk-model-small-en-us-0.15"
 
 # Audio settings
-CHUNK = 2048
-FORMAT = pyaudio.paInt16
 CHANNELS = 1
-RATE = 16000
 AMP_THRESHOLD = 600
+RMS_THRESHOLD = 200
+HIGHPASS_CUTOFF = 80
+
+# Noise gate attack and release in seconds
+GATE_ATTACK = 0.005
+GATE_RELEASE = 0.15
+
+# With --suppress-clicks: the longest burst in ms that counts as a click, and
+# how many times louder than the background it has to be. Shorter than 5 ms
+# is less than the level is measured over.
+CLICK_MAX_MS = 30
+CLICK_MIN_MS = 5
+CLICK_RATIO = 8
+
+# Transcripts the small models tend to produce from noise rather than speech
+IGNORED_PHRASES = ["the", "huh", "uh", "[unk]"]
+
+# Voice activity detection: seconds of sound above the threshold needed to
+# start speaking, and seconds of trailing silence that end an utterance
+VAD_ENTER = 0.25
+ENDPOINT_SILENCE = 1.0
+
+# Share of a second's samples that may clip before it's reported, and the
+# fewest seconds between warnings about it
+CLIP_FRACTION = 0.01
+CLIP_WARN_INTERVAL = 60
+
+# With --pre-emphasis and no coefficient given, the usual one in speech recognition
+PRE_EMPHASIS = 0.97
+
+# Shortest and longest --chunk-ms; below this the level of a chunk is mostly
+# noise, above it the VAD reacts too late to catch the start of a word
+MIN_CHUNK_MS = 10
+MAX_CHUNK_MS = 500
+
+# With --calibrate: seconds of ambient audio measured at startup, the multiple
+# of it taken as the speech threshold, and seconds of silence between re-measuring
+CALIBRATE_SECONDS = 2
+CALIBRATE_MULTIPLIER = 3.0
+RECALIBRATE_SILENCE = 30
+
+# Longest utterance in seconds before it's flushed even if speech continues
+MAX_UTTERANCE = 30
+
+# Seconds a wake word keeps the bot listening after the last transcript
+WAKE_TIMEOUT = 10
+
+# With --dedupe: seconds after a transcript that a near-copy of it is dropped
+DEDUPE_WINDOW = 5
+
+# Transcripts waiting for a worker, and what gives when they fill up
+TRANSCRIPT_QUEUE = 10
+TRANSCRIPT_OVERFLOW = "drop-oldest"
+
+# With --reconnect: seconds without audio before the device counts as gone,
+# and the longest wait between attempts to reopen it
+STALL_TIMEOUT = 3
+RECONNECT_MAX_DELAY = 30
+
+# With --decode-nice: how much lower recognition runs than capture by
+# default, and the seconds of audio capture may get ahead before it drops some
+DECODE_NICE = 10
+CAPTURE_BUFFER = 30
+
+# Times a second the smoothed level meter is sent to WebSocket clients
+METER_RATE = 20
+
+# Seconds between flushes of --stats-csv
+STATS_FLUSH_INTERVAL = 1
+
+# Seconds to wait on shutdown for queued transcripts to be handled
+SHUTDOWN_TIMEOUT = 10
+
+# With --timestamps and no format given, local time to the second
+TIMESTAMP_FORMAT = "%Y-%m-%d %H:%M:%S"
 
 # Ollama API settings
 OLLAMA_URL = "http://localhost:11434/api/chat"
 MODEL_NAME = "llama3.2:1b"
 BOT_NAME = "jimbo"
 
-# Conversation context
+# OpenAI-compatible API settings, used instead of Ollama with --llm-endpoint
+LLM_API_KEY_ENV = "LLM_API_KEY"
+
+# LLM requests: seconds to wait for a reply, tries before giving up on one
+# that fails with a timeout or a server error, and the first retry's delay,
+# doubled after each further failure
+LLM_TIMEOUT = 120
+LLM_ATTEMPTS = 3
+LLM_RETRY_DELAY = 1
+
+# Said with --ask-repeat instead of asking the LLM about a transcript it
+# probably misheard
+REPEAT_PROMPT = "Sorry, I didn't catch that. Could you say it again?"
+
+# Conversation context, and how much of it is sent back with each prompt:
+# exchanges (a prompt and its reply) and a rough token budget
 SYSTEM_PROMPT = f"Your name is {BOT_NAME}. You are a helpful assistant. Keep your responses very brief. Be as concise as possible. Only use as few words as necessary. Laconic."
+MAX_TURNS = 10
+MAX_CONTEXT_TOKENS = 2000
+
+# What "summarize" asks for, with the session's transcripts as the message
+SUMMARY_PROMPT = ("Summarize this transcript of what was said, as a few short sentences covering the main points, "
+                  "decisions and anything to follow up on. It comes from speech recognition, so expect some misheard words.")
+
+# Recent transcripts kept for GET /history and "what did i just say"
+HISTORY_SIZE = 100
+
+# With --replay: utterances whose audio is kept for "replay that"
+REPLAY_SIZE = 5
+
+def locate_model(name) -> Path:
+    path = resolve_model(name)
+    if path is None:
+        if not args.download:
+            raise SystemExit(f"Model not found: {name} (download one from https://alphacephei.com/vosk/models or pass --download)")
+        try:
+            path = download_model(name)
+        except DownloadError as e:
+            raise SystemExit(e)
+    return path
+
+def input_devices(p) -> list[dict]:
+    devices = [p.get_device_info_by_index(i) for i in range(p.get_device_count())]
+    return [d for d in devices if d["maxInputChannels"] > 0]
+
+def rate_arg(value):
+    return value if value == "native" else int(value)
+
+parser = argparse.ArgumentParser(description="Voice activated bot and task runner")
+parser.add_argument("--config", metavar="FILE", help="TOML file setting any of these options; flags given on the command line win")
+parser.add_argument("--model", help=f"Vosk model path or name under {MODEL_DIR}/ (default: {DEFAULT_MODEL})")
+parser.add_argument("--clipboard", action="store_true", help="copy each transcription to the system clipboard, for dictating into other programs")
+parser.add_argument("--transcript-log", metavar="FILE", help="append each transcription to FILE with a timestamp")
+parser.add_argument("--lang", help="language code like en-us or fr; picks a matching model when --model isn't given")
+parser.add_argument("--vad-metric", choices=["peak", "rms"], default="peak", help="level the VAD compares against its threshold (default: peak)")
+parser.add_argument("--ptt", metavar="FIFO", help="push to talk: only transcribe between 'press' and 'release' lines written to FIFO, ignoring the VAD")
+parser.add_argument("--calibrate", action="store_true", help=f"set the speech threshold from the ambient noise, measured for {CALIBRATE_SECONDS}s at startup and again after long silences")
+parser.add_argument("--calibrate-multiplier", type=float, default=CALIBRATE_MULTIPLIER, metavar="X", help=f"with --calibrate, how many times the ambient level counts as speech (default: {CALIBRATE_MULTIPLIER})")
+parser.add_argument("--rms-threshold", type=float, default=RMS_THRESHOLD, help=f"speech threshold when --vad-metric=rms (default: {RMS_THRESHOLD})")
+parser.add_argument("--llm-endpoint", metavar="URL", help=f"OpenAI-compatible API base URL like http://localhost:8080/v1 to use instead of Ollama; the key is read from ${LLM_API_KEY_ENV}")
+parser.add_argument("--llm-model", default=MODEL_NAME, help=f"chat model name (default: {MODEL_NAME})")
+parser.add_argument("--llm-min-confidence", type=float, metavar="0-1", help="only send transcripts to the LLM when their average word confidence is at least this")
+parser.add_argument("--ask-repeat", action="store_true", help="with --llm-min-confidence, ask for a transcript that isn't sent to be said again")
+parser.add_argument("--llm-attempts", type=int, default=LLM_ATTEMPTS, metavar="N", help=f"tries for an LLM request that times out or gets a server error, with backoff (default: {LLM_ATTEMPTS})")
+parser.add_argument("--max-turns", type=int, default=MAX_TURNS, help=f"earlier exchanges sent along with each prompt (default: {MAX_TURNS})")
+parser.add_argument("--replay", type=int, nargs="?", const=REPLAY_SIZE, metavar="N", help=f"keep the audio of the last N utterances (default N: {REPLAY_SIZE}) to play back with \"replay that\" or POST /replay")
+parser.add_argument("--history", type=int, default=HISTORY_SIZE, metavar="N", help=f"recent transcripts to keep in memory for GET /history (default: {HISTORY_SIZE})")
+parser.add_argument("--max-context-tokens", type=int, default=MAX_CONTEXT_TOKENS, metavar="N", help=f"rough cap on the tokens of earlier exchanges sent with each prompt (default: {MAX_CONTEXT_TOKENS})")
+parser.add_argument("--no-tts", action="store_true", help="print chatbot replies without speaking them")
+parser.add_argument("--clip-fraction", type=float, default=CLIP_FRACTION, metavar="0-1", help=f"warn when more than this share of a second's samples are at full scale, 0 to never warn (default: {CLIP_FRACTION})")
+parser.add_argument("--barge-in", type=float, metavar="LEVEL", help="stop speaking a reply when the microphone hears LEVEL, which has to be louder than the reply itself sounds there")
+parser.add_argument("--wake-word", metavar="PHRASE", help="ignore everything until PHRASE is heard")
+parser.add_argument("--wake-model", metavar="MODEL", help="small model that listens all the time for the wake word; what's said after it is transcribed again with --model")
+parser.add_argument("--pre-roll", type=float, default=VAD_ENTER, metavar="SECONDS", help=f"audio from before speech was detected to include at the start of an utterance, so a soft first word isn't clipped (default: {VAD_ENTER})")
+parser.add_argument("--wake-timeout", type=float, default=WAKE_TIMEOUT, help=f"seconds to keep listening after the wake word or the last command (default: {WAKE_TIMEOUT})")
+parser.add_argument("--json", action="store_true", help="write transcriptions, replies and errors to stdout as JSON lines")
+parser.add_argument("--turns", action="store_true", help="number speaker turns, guessing where the speaker changes from the pitch and loudness of each utterance")
+parser.add_argument("--timestamps", nargs="?", const=TIMESTAMP_FORMAT, metavar="FORMAT", help=f"start transcript, reply and log lines with the time, in strftime FORMAT (default: {TIMESTAMP_FORMAT.replace('%', '%%')})")
+parser.add_argument("--jsonl", metavar="FILE", help="also append the JSON messages to FILE, whatever goes to stdout")
+parser.add_argument("--highpass", type=float, metavar="HZ", help=f"high-pass filter cutoff to cut rumble below HZ, e.g. {HIGHPASS_CUTOFF}")
+parser.add_argument("--suppress-clicks", action="store_true", help="turn down short loud bursts like keyboard clicks before the VAD and recognizer hear them")
+parser.add_argument("--click-max-ms", type=float, default=CLICK_MAX_MS, metavar="MS", help=f"with --suppress-clicks, the longest burst that counts as a click (default: {CLICK_MAX_MS})")
+parser.add_argument("--click-ratio", type=float, default=CLICK_RATIO, metavar="X", help=f"with --suppress-clicks, how many times louder than the background a click is (default: {CLICK_RATIO})")
+parser.add_argument("--agc", action="store_true", help="automatic gain control so quiet speakers still cross the VAD threshold")
+parser.add_argument("--pre-emphasis", type=float, nargs="?", const=PRE_EMPHASIS, metavar="COEFFICIENT", help=f"boost high frequencies in what the recognizer hears, for muffled microphones (default coefficient: {PRE_EMPHASIS})")
+parser.add_argument("--denoise", action="store_true", help="subtract steady background noise (fans, hum) learned while nobody's talking; costs some CPU")
+parser.add_argument("--noise-gate", type=float, metavar="LEVEL", help="softly attenuate samples quieter than LEVEL before recognition; the VAD still sees the ungated audio")
+parser.add_argument("--gate-attack", type=float, default=GATE_ATTACK, metavar="SECONDS", help=f"how fast the noise gate opens (default: {GATE_ATTACK})")
+parser.add_argument("--gate-release", type=float, default=GATE_RELEASE, metavar="SECONDS", help=f"how fast the noise gate closes (default: {GATE_RELEASE})")
+parser.add_argument("--chunk-ms", type=int, default=CHUNK * 1000 // RATE, metavar="MS", help=f"audio read and metered at a time; shorter reacts faster, longer gives a steadier level and less overhead (default: {CHUNK * 1000 // RATE})")
+parser.add_argument("--sample-format", choices=SAMPLE_FORMATS, default="s16", help="sample format to capture in, for interfaces that only offer 24-bit or float; converted to 16-bit for recognition (default: s16)")
+parser.add_argument("--capture-rate", type=rate_arg, default=RATE, metavar="HZ", help=f"rate to capture at, or 'native' for the device default; audio is resampled to {RATE} Hz for recognition (default: {RATE})")
+parser.add_argument("--ws-queue", type=int, default=WS_CLIENT_QUEUE, metavar="N", help=f"messages buffered for each WebSocket client (default: {WS_CLIENT_QUEUE})")
+parser.add_argument("--ws-overflow", choices=QUEUE_POLICIES[:2], default=WS_OVERFLOW, help=f"which messages a slow WebSocket client misses (default: {WS_OVERFLOW})")
+parser.add_argument("--ws-addr", metavar="HOST:PORT", help="serve live transcriptions and audio levels over WebSocket")
+parser.add_argument("--stats-csv", metavar="FILE", help="write the RMS, mean and peak level and VAD state of every chunk to FILE as CSV, for tuning the threshold")
+parser.add_argument("--session-wav", metavar="FILE", help="record the whole session, silence included, into one WAV")
+parser.add_argument("--keep-audio", metavar="DIR", help="save each utterance to DIR as a WAV named after its transcript")
+parser.add_argument("--vocab-file", metavar="FILE", help="restrict recognition to the words and phrases in FILE, one per line")
+parser.add_argument("--min-utterance", type=float, metavar="SECONDS", help="drop utterances with less than this much audio above the VAD threshold, like clicks, e.g. 0.3")
+parser.add_argument("--max-utterance", type=float, default=MAX_UTTERANCE, metavar="SECONDS", help=f"flush an utterance after this long even if speech continues (default: {MAX_UTTERANCE})")
+parser.add_argument("--log-level", choices=["debug", "info", "warning", "error"], default="info", help="log verbosity on stderr (default: info)")
+parser.add_argument("--quiet", action="store_true", help="don't log the per-chunk audio level, even at debug")
+parser.add_argument("--download", action="store_true", help=f"download the model into {MODEL_DIR}/ if it's missing")
+parser.add_argument("--subtitle-out", metavar="FILE", help="write the session as subtitles on exit, SRT or WebVTT by the file extension")
+parser.add_argument("--channels", type=int, default=CHANNELS, help=f"channels to capture, downmixed to mono for recognition (default: {CHANNELS})")
+parser.add_argument("--mono-mix", choices=["average", "left", "right"], default="average", help="how to downmix multi-channel capture (default: average)")
+parser.add_argument("--http-addr", metavar="HOST:PORT", help="serve an HTTP API, POST a WAV to /transcribe to transcribe it")
+parser.add_argument("--transcript-queue", type=int, default=TRANSCRIPT_QUEUE, metavar="N", help=f"transcripts that can wait for a worker (default: {TRANSCRIPT_QUEUE})")
+parser.add_argument("--transcript-overflow", choices=QUEUE_POLICIES, default=TRANSCRIPT_OVERFLOW, help=f"what happens to a transcript when the queue is full; block holds up capture (default: {TRANSCRIPT_OVERFLOW})")
+parser.add_argument("--workers", type=int, default=1, help="threads handling transcripts; more than one lets a slow LLM call overlap a command but loses ordering (default: 1)")
+parser.add_argument("--endpoint-silence", type=float, default=ENDPOINT_SILENCE, metavar="SECONDS", help=f"trailing silence that ends an utterance; shorter replies faster but may split sentences at pauses (default: {ENDPOINT_SILENCE})")
+parser.add_argument("--min-confidence", type=float, metavar="0-1", help="drop transcripts whose average word confidence is below this")
+parser.add_argument("--ignore-phrases", metavar="A,B,...", help=f"comma-separated transcripts to drop as noise, empty to keep everything (default: {','.join(IGNORED_PHRASES)})")
+parser.add_argument("--min-level", type=float, help="drop transcripts whose loudest chunk is below this level, a stricter floor than the VAD threshold")
+parser.add_argument("--decode-nice", type=int, nargs="?", const=DECODE_NICE, metavar="N", help=f"capture on a thread of its own and run recognition N lower in priority (default N: {DECODE_NICE}), so a busy machine drops recognition time rather than audio; Linux only")
+parser.add_argument("--reconnect", action="store_true", help="when the capture device fails or stops delivering audio, keep trying to reopen it")
+parser.add_argument("--dedupe", type=int, metavar="0-100", help=f"drop a transcript this similar to the one before it, if it came within {DEDUPE_WINDOW}s")
+parser.add_argument("--words", action="store_true", help="include each word's start and end time in the JSON and HTTP output")
+parser.add_argument("--capitalize", action="store_true", help="capitalize the start of every transcript shown, logged or sent to the LLM")
+parser.add_argument("--punctuate", action="store_true", help="end every transcript shown, logged or sent to the LLM with a full stop")
+parser.add_argument("--partials", action="store_true", help="show the transcript as it's being spoken, before the utterance ends")
+parser.add_argument("--once", action="store_true", help="exit after the first transcript, printing only it, without running commands or replying")
+parser.add_argument("--timeout", type=float, metavar="SECONDS", help="with --once, give up and exit with status 1 if nothing is transcribed within SECONDS")
+parser.add_argument("--input-dir", metavar="DIR", help="transcribe every WAV file in DIR as fast as possible, write the results as JSON lines and exit")
+parser.add_argument("--batch-results", metavar="FILE", help="where --input-dir writes its results (default: DIR/results.jsonl)")
+parser.add_argument("--stdin", action="store_true", help="read raw 16 kHz mono 16-bit little-endian PCM from stdin instead of the microphone, exiting at the end of it")
+parser.add_argument("--input-file", metavar="WAV", help="read audio from a WAV file in real time instead of the microphone, then exit")
+parser.add_argument("--list-devices", action="store_true", help="list capture devices and exit")
+parser.add_argument("--device", type=int, metavar="N", help="capture device index from --list-devices (default: system default)")
+# defaults < config file < command line
+config_path = parser.parse_known_args()[0].config
+if config_path:
+    try:
+        parser.set_defaults(**load_config(parser, config_path))
+    except ValueError as e:
+        raise SystemExit(e)
+args = parser.parse_args()
+
+# logs go to stderr so stdout only carries transcripts, replies and JSON
+# --timestamps puts the same times on the log lines as on the transcripts
+logging.basicConfig(level=args.log_level.upper(), format="%(asctime)s %(levelname)s %(message)s", datefmt=args.timestamps,
+                    stream=sys.stderr)
+log = logging.getLogger("jarvis")
+
+def terminate(signum, frame):
+    # unwinds like Ctrl+C does, so the shutdown below still finishes the files
+    # being written and a model download cleans up after itself
+    raise SystemExit(128 + signum)
+
+# what systemd, docker stop and a plain kill send
+signal.signal(signal.SIGTERM, terminate)
+
+if args.ws_queue < 1:
+    raise SystemExit("--ws-queue must be at least 1")
+
+metrics = Metrics()
+
+def emit(kind, **fields):
+    stamp = datetime.now().astimezone().isoformat(timespec="milliseconds")
+    sinks.send({"type": kind, "timestamp": stamp, **fields})
+
+def report_error(error):
+    metrics.inc("errors_total")
+    emit("error", message=str(error))
+    if not args.json or args.once:
+        log.error(error)
+
+if args.stdin and (args.input_file or args.input_dir):
+    raise SystemExit("--stdin can't be used with --input-file or --input-dir")
+
+# Initialize PyAudio, which stdin input and a batch of files have no use
+# for, so they run where there's no sound system at all
+if args.list_devices or not (args.stdin or args.input_dir):
+    p = pyaudio.PyAudio()
+    devices = input_devices(p)
+    if args.list_devices:
+        for d in devices:
+            print(f"{d['index']}: {d['name']} ({d['maxInputChannels']} ch, {d['defaultSampleRate']:.0f} Hz)")
+        p.terminate()
+        raise SystemExit(0)
+    if args.device is not None and args.device not in [d["index"] for d in devices]:
+        p.terminate()
+        raise SystemExit(f"No capture device with index {args.device}, see --list-devices")
+    p.terminate()
+
+# Load Vosk model. Vosk models are trained for a single language, so the
+# language is chosen by picking a model rather than detected from the audio.
+if args.lang == "auto":
+    raise SystemExit("Vosk can't auto-detect the language, pass a language code like --lang en-us")
+
+def load_model(path) -> Model:
+    check_model(path)
+    info = model_info(path)
+    log.info("Using model %s (%.1f MB): %s, %s words, %s graph%s", path.name, model_size(path) / 1e6,
+             info["language"] or "unknown language", f"{info['words']:,}" if info["words"] else "unknown number of",
+             "runtime" if info["runtime_graph"] else "static", ", with rescoring" if info["rescoring"] else "")
+    if info["rate"] and info["rate"] != RATE:
+        log.warning("%s was trained on %d Hz audio but is given %d Hz, expect poor accuracy", path.name, info["rate"], RATE)
+    if args.lang and info["language"] and info["language"].split("-")[0] != args.lang.lower().split("-")[0]:
+        # --model wins, --lang only picks a model when there isn't one
+        log.warning("%s is a %s model, --lang %s doesn't change what it recognizes", path.name, info["language"], args.lang)
+    if args.vocab_file and not info["runtime_graph"]:
+        log.warning("%s has a static graph, vosk will ignore --vocab-file", path.name)
+    try:
+        return Model(str(path))
+    except Exception as e:
+        # vosk only says it failed, and the details go to its own log
+        raise ValueError(f"vosk couldn't load {path} ({e}), it may be corrupt, delete it and download it again") from e
+
+if args.model is None and args.lang:
+    model_path = find_model_for_lang(args.lang)
+    if model_path is None:
+        if not args.download:
+            raise SystemExit(f"No {args.lang} model in {MODEL_DIR}/ (download one from https://alphacephei.com/vosk/models "
+                             "or pass --download)")
+        log.info("No model for %s in %s/, downloading one", args.lang, MODEL_DIR)
+        try:
+            model_path = download_model_for_lang(args.lang)
+        except DownloadError as e:
+            raise SystemExit(e)
+else:
+    model_path = locate_model(args.model or DEFAULT_MODEL)
+try:
+    model = load_model(model_path)
+except ValueError as e:
+    raise SystemExit(e)
+if args.wake_model:
+    if not args.wake_word:
+        raise SystemExit("--wake-model needs a --wake-word to listen for")
+    # both models stay in memory, so pair a big model with a small one
+    try:
+        wake_model = load_model(locate_model(args.wake_model))
+    except ValueError as e:
+        raise SystemExit(e)
+else:
+    wake_model = None
+
+def load_vocab(path) -> str:
+    phrases = [line.strip().lower() for line in Path(path).read_text(encoding="utf-8").splitlines()]
+    # [unk] lets out-of-vocabulary speech come out as unknown instead of
+    # being forced onto the closest phrase
+    return json.dumps([p for p in phrases if p] + ["[unk]"])
+
+vocab = load_vocab(args.vocab_file) if args.vocab_file else None
+
+if args.channels < 1 or (args.mono_mix == "right" and args.channels < 2):
+    raise SystemExit(f"Can't use --mono-mix {args.mono_mix} with {args.channels} channel(s)")
+
+# the VAD uses the peak level against AMP_THRESHOLD unless --vad-metric=rms
+if args.vad_metric == "rms":
+    audio_level = rms_level
+    threshold = args.rms_threshold
+else:
+    audio_level = peak_level
+    threshold = AMP_THRESHOLD
+if not MIN_CHUNK_MS <= args.chunk_ms <= MAX_CHUNK_MS:
+    raise SystemExit(f"--chunk-ms must be between {MIN_CHUNK_MS} and {MAX_CHUNK_MS}")
+chunk = args.chunk_ms * RATE // 1000
+
+def chunks(seconds) -> int:
+    return max(1, math.ceil(seconds * RATE / chunk))
+
+ignored_phrases = set(IGNORED_PHRASES if args.ignore_phrases is None else
+                      [p.strip().lower() for p in args.ignore_phrases.split(",") if p.strip()])
+
+# for whatever people and the LLM read, commands and the wake word still
+# match against what the recognizer said
+text_chain = TextChain([Strip()] + ([Capitalize()] if args.capitalize else []) +
+                       ([EndPunctuation()] if args.punctuate else []))
+
+def tidy(text) -> str:
+    return text_chain.process(text)
+
+def transcribe_dir(directory, results_path, transcriber):
+    """Transcribes every WAV in directory one after another with the main
+    model, a line per file, and logs the totals."""
+    files = sorted(f for f in Path(directory).iterdir() if f.suffix.lower() == ".wav")
+    if not files:
+        raise SystemExit(f"No WAV files in {directory}")
+    audio_seconds = decode_seconds = 0.0
+    failed = 0
+    with open(results_path, "w", encoding="utf-8") as results:
+        for f in files:
+            try:
+                with open(f, "rb") as fh:
+                    samples = read_wav(fh)
+            except (OSError, wave.Error, EOFError, ValueError) as e:
+                log.warning("Can't read %s: %s", f.name, e)
+                results.write(json.dumps({"file": f.name, "error": str(e)}) + "\n")
+                failed += 1
+                continue
+            started = time.perf_counter()
+            segments = transcriber.transcribe(samples)
+            elapsed = time.perf_counter() - started
+            duration = len(samples) / RATE
+            audio_seconds += duration
+            decode_seconds += elapsed
+            text = tidy(" ".join(s.text for s in segments))
+            confidences = [s.confidence for s in segments if s.confidence is not None]
+            results.write(json.dumps({"file": f.name, "text": text, "duration": duration, "decode_time": elapsed,
+                                      "confidence": sum(confidences) / len(confidences) if confidences else None}) + "\n")
+            log.info("%s (%.1fs, %.2fs to decode): %s", f.name, duration, elapsed, text)
+    log.info("Transcribed %d file(s), %.1fs of audio in %.1fs (real-time factor %.2f)%s, results in %s",
+             len(files) - failed, audio_seconds, decode_seconds, decode_seconds / audio_seconds if audio_seconds else 0,
+             f", {failed} unreadable" if failed else "", results_path)
+
+if args.input_dir:
+    if args.input_file:
+        raise SystemExit("--input-dir and --input-file can't be used together")
+    if not Path(args.input_dir).is_dir():
+        raise SystemExit(f"{args.input_dir} isn't a directory")
+    # before any capture or output is set up, none of it is used; a VAD
+    # only because a Transcriber needs one, transcribe() goes without
+    batch = Transcriber(model, VoiceActivityDetector(threshold, 1, 1), vocab=vocab, level=audio_level,
+                        min_confidence=args.min_confidence, ignored_phrases=ignored_phrases, words=args.words)
+    transcribe_dir(args.input_dir, args.batch_results or Path(args.input_dir) / "results.jsonl", batch)
+    raise SystemExit(0)
+
+if args.ws_addr:
+    ws_server = WebSocketServer(*parse_addr(args.ws_addr), args.ws_queue, args.ws_overflow,
+                                lambda: metrics.inc("ws_messages_dropped_total"))
+else:
+    ws_server = None
+
+if args.json:
+    # --once promises a single line, the transcript's
+    outputs = [JSONLinesSink(sys.stdout, {"transcription"} if args.once else None)]
+else:
+    outputs = [TextSink() if args.once else ConsoleSink(args.timestamps)]
+if args.jsonl:
+    outputs.append(JSONLinesSink(open(args.jsonl, "a", encoding="utf-8")))
+if ws_server:
+    outputs.append(WebSocketSink(ws_server))
+sinks = Multiplexer(outputs)
+
+def read_ptt(path, held):
+    """Holds the key down from a "press" line in the FIFO to a "release" line."""
+    while True:
+        # blocks until something opens the FIFO to write, and starts over
+        # when it's closed again
+        with open(path) as f:
+            for line in f:
+                command = line.strip()
+                if command == "press":
+                    held.set()
+                elif command == "release":
+                    held.clear()
+                elif command:
+                    log.warning("Unknown push-to-talk command %r, expected press or release", command)
+
+if args.ptt:
+    if not os.path.exists(args.ptt):
+        os.mkfifo(args.ptt)
+    elif not Path(args.ptt).is_fifo():
+        raise SystemExit(f"{args.ptt} exists and isn't a FIFO")
+    vad = PushToTalk(threshold)
+    threading.Thread(target=read_ptt, args=(args.ptt, vad.held), daemon=True).start()
+    log.info("Push to talk: write press and release to %s", args.ptt)
+else:
+    # the endpoint silence is the hangover, counted in chunks
+    vad = VoiceActivityDetector(threshold, chunks(VAD_ENTER), chunks(args.endpoint_silence))
+if args.calibrate:
+    calibrator = Calibrator(vad, args.calibrate_multiplier, chunks(CALIBRATE_SECONDS), chunks(RECALIBRATE_SILENCE))
+else:
+    calibrator = None
+
+if args.suppress_clicks and (args.click_max_ms < CLICK_MIN_MS or args.click_ratio <= 1):
+    raise SystemExit(f"--click-max-ms must be at least {CLICK_MIN_MS} and --click-ratio more than 1")
+
+# applied in order to every chunk before level metering and recognition
+filters = []
+if args.highpass:
+    filters.append(HighPassFilter(args.highpass))
+if args.suppress_clicks:
+    # ahead of the AGC, which would lift the quiet between clicks
+    filters.append(TransientSuppressor(args.click_max_ms / 1000, args.click_ratio))
+if args.agc:
+    filters.append(AGC())
+
+class TranscriptLog:
+    def __init__(self, path):
+        self.file = open(path, "a", encoding="utf-8")
+        self.lock = threading.Lock()
+
+    def write(self, text):
+        stamp = datetime.now().astimezone().isoformat(timespec="seconds")
+        with self.lock:
+            self.file.write(f"{stamp} {text}\n")
+            self.file.flush()
+
+    def close(self):
+        with self.lock:
+            self.file.close()
+
+transcript_log = TranscriptLog(args.transcript_log) if args.transcript_log else None
+
+class Clipboard:
+    """Copies text to the system clipboard through whichever command-line
+    tool the platform has, giving up quietly after the first failure."""
+
+    # tried in order, the first found on PATH is used
+    COMMANDS = [["wl-copy"], ["xclip", "-selection", "clipboard"], ["xsel", "--clipboard", "--input"], ["pbcopy"],
+                ["clip.exe"]]
+
+    def __init__(self):
+        self.command = next((c for c in self.COMMANDS if shutil.which(c[0])), None)
+        self.lock = threading.Lock()
+        if self.command is None:
+            log.warning("No clipboard tool found (install wl-clipboard, xclip or xsel), not copying transcripts")
+
+    def copy(self, text):
+        with self.lock:
+            if self.command is None:
+                return
+            try:
+                subprocess.run(self.command, input=text.encode(), check=True, timeout=5, capture_output=True)
+            except (OSError, subprocess.SubprocessError) as e:
+                # no display to copy to, most likely, and it won't get one later
+                log.warning("Copying to the clipboard with %s failed (%s), not trying again", self.command[0], e)
+                self.command = None
+
+clipboard = Clipboard() if args.clipboard else None
+
+class AudioArchive:
+    """Saves utterances as numbered WAVs so audio can be matched to its
+    transcript, listing each in manifest.jsonl alongside them."""
+
+    def __init__(self, directory):
+        self.directory = Path(directory)
+        self.directory.mkdir(parents=True, exist_ok=True)
+        # carry on after the highest number, deleted files can leave gaps a
+        # count would reuse
+        numbers = [int(m.group(1)) for f in self.directory.glob("*.wav") if (m := re.match(r"(\d+)-", f.name))]
+        self.seq = max(numbers, default=0)
+        self.manifest = open(self.directory / "manifest.jsonl", "a", encoding="utf-8")
+
+    def save(self, segment) -> Path:
+        self.seq += 1
+        name = re.sub(r"[^a-z0-9]+", "_", segment.text.lower()).strip("_")[:50] or "empty"
+        path = self.directory / f"{self.seq:05d}-{name}.wav"
+        write_wav(path, segment.audio)
+        self.manifest.write(json.dumps({"file": path.name, "index": self.seq, "start": segment.start,
+                                        "start_time": wall_clock(segment.start), "duration": segment.end - segment.start,
+                                        "level": segment.level, "confidence": segment.confidence,
+                                        "text": segment.text}) + "\n")
+        self.manifest.flush()
+        return path
+
+    def close(self):
+        self.manifest.close()
+
+audio_archive = AudioArchive(args.keep_audio) if args.keep_audio else None
+
+def play_pcm(audio):
+    p = pyaudio.PyAudio()
+    try:
+        stream = p.open(format=pyaudio.paInt16, channels=1, rate=RATE, output=True)
+        try:
+            stream.write(audio)
+        finally:
+            stream.stop_stream()
+            stream.close()
+    finally:
+        p.terminate()
+
+class CaptureMute:
+    """Mutes capture while we play audio of our own, speech or a replay, until
+    the last of them has finished."""
+
+    def __init__(self):
+        self.event = threading.Event()  # what the transcriber checks
+        self.count = 0
+        self.lock = threading.Lock()
+
+    def __enter__(self):
+        with self.lock:
+            self.count += 1
+            self.event.set()
+
+    def __exit__(self, *exc_info):
+        with self.lock:
+            self.count -= 1
+            if not self.count:
+                self.event.clear()
+
+capture_mute = CaptureMute()
+
+class ReplayBuffer:
+    """The audio of the last few utterances as the recognizer heard it, to
+    play back when a transcript looks wrong."""
+
+    def __init__(self, size):
+        self.entries = deque(maxlen=size)  # (text, 16-bit PCM), newest last
+        self.lock = threading.Lock()
+
+    def add(self, segment):
+        with self.lock:
+            self.entries.append((segment.text, bytes(segment.audio)))
+
+    def play(self, back=1) -> str|None:
+        """Plays the utterance back from the newest, 1 being the newest, and
+        returns its transcript, or None if there aren't that many."""
+        with self.lock:
+            if len(self.entries) < back:
+                return None
+            text, audio = self.entries[-back]
+        log.info("Replaying %r", text)
+        # muted like the speaker is, or we'd transcribe it all over again
+        with capture_mute:
+            play_pcm(audio)
+        return text
+
+if args.replay is not None and args.replay < 1:
+    raise SystemExit("--replay must keep at least 1 utterance")
+replay = ReplayBuffer(args.replay) if args.replay else None
+
+class SessionWav:
+    """Records everything captured, silence included, into one WAV."""
+
+    def __init__(self, path):
+        self.file = wave.open(str(path), "wb")
+        self.file.setnchannels(1)
+        self.file.setsampwidth(2)
+        self.file.setframerate(RATE)
+
+    def write(self, pcm):
+        # wave rewrites the header's length after every write, so the file
+        # stays playable even if we never get to close it
+        self.file.writeframes(pcm)
+
+    def close(self):
+        self.file.close()
+
+session_wav = SessionWav(args.session_wav) if args.session_wav else None
+
+def subtitle_time(seconds, separator) -> str:
+    ms = round(seconds * 1000)
+    return f"{ms // 3600000:02d}:{ms // 60000 % 60:02d}:{ms // 1000 % 60:02d}{separator}{ms % 1000:03d}"
 
-# Load Vosk model
-model = Model("model/vosk-model-small-en-us-0.15")
-rec = KaldiRecognizer(model, RATE)
+class Subtitles:
+    """Collects the session's segments and writes them out as SRT or WebVTT."""
 
-# Initialize PyAudio
-p = pyaudio.PyAudio()
-stream = p.open(format=FORMAT, channels=CHANNELS, rate=RATE, input=True, frames_per_buffer=CHUNK)
+    def __init__(self, path):
+        self.path = Path(path)
+        if self.path.suffix.lower() not in (".srt", ".vtt"):
+            raise SystemExit(f"Can't tell the subtitle format of {path}, use a .srt or .vtt extension")
+        self.segments = []
+
+    def add(self, segment):
+        self.segments.append(segment)
+
+    def write(self):
+        vtt = self.path.suffix.lower() == ".vtt"
+        separator = "." if vtt else ","
+        lines = ["WEBVTT", ""] if vtt else []
+        for i, segment in enumerate(self.segments, 1):
+            lines += [str(i), f"{subtitle_time(segment.start, separator)} --> {subtitle_time(segment.end, separator)}", segment.text, ""]
+        self.path.write_text("\n".join(lines), encoding="utf-8")
+
+subtitles = Subtitles(args.subtitle_out) if args.subtitle_out else None
+
+class History:
+    """The last few transcripts, newest last, shared by the workers and the HTTP API."""
+
+    def __init__(self, size):
+        self.entries = deque(maxlen=size)
+        self.lock = threading.Lock()
+
+    def add(self, entry):
+        with self.lock:
+            self.entries.append(entry)
+
+    def recent(self, n=None) -> list[dict]:
+        with self.lock:
+            entries = list(self.entries)
+        return entries if n is None else entries[max(len(entries) - n, 0):]
+
+if args.history < 0:
+    raise SystemExit("--history can't be negative")
+history = History(args.history)
+
+class SessionTranscript:
+    """Every transcript since we started, for summarizing however long the
+    session has run; unlike History it's never trimmed."""
+
+    def __init__(self):
+        self.lines = []
+        self.lock = threading.Lock()
+
+    def add(self, text):
+        with self.lock:
+            self.lines.append(text)
+
+    def all(self) -> list[str]:
+        with self.lock:
+            return list(self.lines)
+
+session = SessionTranscript()
+
+meter = LevelMeter()
+
+class StatsCSV:
+    """Writes a row of level statistics for every chunk, for plotting when
+    tuning the VAD."""
+
+    def __init__(self, path):
+        self.file = open(path, "w", newline="", encoding="utf-8")
+        self.writer = csv.writer(self.file)
+        self.writer.writerow(["time", "seconds", "rms", "mean_abs", "peak", "threshold", "speaking"])
+        self.seconds = 0.0
+        self.flushed = time.monotonic()
+
+    def write(self, samples, speaking):
+        self.seconds += len(samples) / RATE
+        self.writer.writerow([datetime.now().astimezone().isoformat(timespec="milliseconds"), f"{self.seconds:.3f}",
+                              f"{rms_level(samples):.1f}", f"{mean_abs_level(samples):.1f}",
+                              f"{peak_level(samples):.0f}", f"{vad.threshold:.0f}", int(speaking)])
+        # often enough to plot while it's running, not on every chunk
+        if time.monotonic() - self.flushed >= STATS_FLUSH_INTERVAL:
+            self.file.flush()
+            self.flushed = time.monotonic()
+
+    def close(self):
+        self.file.close()
+
+stats_csv = StatsCSV(args.stats_csv) if args.stats_csv else None
+
+def show_level(level, speaking):
+    if not args.quiet:
+        log.debug("Audio level %.0f%s", level, " (speaking)" if speaking else "")
+    meter.update(level)
+    if ws_server:
+        ws_server.broadcast(json.dumps({"type": "level", "level": level, "speaking": speaking}))
+
+def send_meter():
+    # at a steady rate whatever the chunk size, and between transcripts too
+    while True:
+        time.sleep(1 / METER_RATE)
+        ws_server.broadcast(json.dumps({"type": "meter", "level": round(meter.value, 3)}))
+
+if ws_server:
+    threading.Thread(target=send_meter, daemon=True).start()
+
+def show_partial(text, start):
+    emit("partial", text=text, start=start)
+
+class ClipReporter:
+    """Counts each second of clipped audio, warning about it now and then."""
+
+    def __init__(self, interval):
+        self.interval = interval
+        self.last_warning = None
+
+    def report(self):
+        metrics.inc("clipping_seconds_total")
+        now = time.monotonic()
+        if self.last_warning is None or now - self.last_warning >= self.interval:
+            log.warning("Clipping detected, reduce the input gain")
+            self.last_warning = now
+
+clip_reporter = ClipReporter(CLIP_WARN_INTERVAL)
+
+def wall_clock(seconds) -> str:
+    return datetime.fromtimestamp(transcriber.wall_time(seconds)).astimezone().isoformat(timespec="milliseconds")
+
+def speech_started(start):
+    emit("speech_start", start=start, start_time=wall_clock(start))
+
+def speech_ended(start, end):
+    emit("speech_end", start=start, duration=end - start)
+
+if args.timeout is not None and (not args.once or args.timeout <= 0):
+    raise SystemExit("--timeout needs --once and more than 0 seconds")
+if not 0 <= args.clip_fraction < 1:
+    raise SystemExit("--clip-fraction must be from 0 up to 1")
+if args.pre_emphasis is not None and not 0 < args.pre_emphasis < 1:
+    raise SystemExit("--pre-emphasis must be between 0 and 1")
+if args.pre_roll < 0:
+    raise SystemExit("--pre-roll can't be negative")
+if args.gate_attack <= 0 or args.gate_release <= 0:
+    raise SystemExit("--gate-attack and --gate-release must be more than 0")
+gate = NoiseGate(args.noise_gate, args.gate_attack, args.gate_release) if args.noise_gate else None
+
+if args.decode_nice is not None and args.decode_nice < 0:
+    raise SystemExit("--decode-nice can only lower the priority, it can't be negative")
+
+transcriber = Transcriber(wake_model or model, vad, vocab=vocab, level=audio_level, muted=capture_mute.event,
+                          clip_detector=ClipDetector(args.clip_fraction) if args.clip_fraction else None, filters=filters,
+                          denoiser=SpectralDenoiser() if args.denoise else None, gate=gate,
+                          emphasis=PreEmphasis(args.pre_emphasis) if args.pre_emphasis is not None else None,
+                          pre_roll=chunks(args.pre_roll),
+                          calibrator=calibrator, max_utterance=args.max_utterance, min_utterance=args.min_utterance,
+                          min_level=args.min_level, min_confidence=args.min_confidence, ignored_phrases=ignored_phrases,
+                          words=args.words, pitch=args.turns, keep_audio=bool(args.keep_audio or wake_model or replay),
+                          reconnect=args.reconnect, on_audio=session_wav.write if session_wav else None, on_level=show_level,
+                          on_chunk=stats_csv.write if stats_csv else None, nice=args.decode_nice or 0,
+                          # the speaker is made later, and there's none with --no-tts
+                          barge_in_level=args.barge_in,
+                          on_barge_in=(lambda: speaker and speaker.stop()) if args.barge_in else None,
+                          on_partial=show_partial if args.partials else None, on_warning=report_error,
+                          on_too_short=lambda: metrics.inc("utterances_too_short_total"),
+                          on_speech_start=speech_started, on_speech_end=speech_ended, on_clipping=clip_reporter.report)
+# the main model for whatever needs the accurate transcript
+if wake_model:
+    accurate = Transcriber(model, vad, vocab=vocab, level=audio_level, min_confidence=args.min_confidence,
+                           ignored_phrases=ignored_phrases, words=args.words)
+else:
+    accurate = transcriber
+
+class ModelReloader:
+    """Swaps the main model for another, or a fresh load of itself, while
+    transcription carries on with the old one until the new one is ready."""
+
+    def __init__(self, path, transcriber):
+        self.path = path
+        self.transcriber = transcriber
+        # of the model transcripts come from, for their JSON
+        self.language = model_language(path)
+        self.lock = threading.Lock()  # so two reloads don't race
+
+    def reload(self, name=None) -> Path:
+        """Raises FileNotFoundError if there's no such model and ValueError if
+        it can't be loaded, leaving the old one in use."""
+        with self.lock:
+            path = resolve_model(name) if name else self.path
+            if path is None:
+                raise FileNotFoundError(f"no model called {name}")
+            # vosk frees the old model once the last recognizer using it is gone
+            self.transcriber.set_model(load_model(path))
+            self.path = path
+            self.language = model_language(path)
+            return path
+
+# with a wake model the main one is only used for retranscribing
+reloader = ModelReloader(model_path, accurate)
+
+if args.http_addr:
+    http_server = APIServer(parse_addr(args.http_addr), history, metrics, transcriber.capturing,
+                            lambda samples: [replace(s, text=tidy(s.text)) for s in accurate.transcribe(samples)],
+                            reloader, replay)
+    threading.Thread(target=http_server.serve_forever, daemon=True).start()
+else:
+    http_server = None
 
 def find_artist(query) -> str|bool:
     top = ("", 0)
@@ -61,7 +899,7 @@ def find_any(query) -> str|bool:
         check=True
     )
     tracks = [line.strip() for line in result.stdout.splitlines() if line.strip()]
-    print(tracks)
+    log.debug("Library titles: %s", tracks)
     for track in tracks:
         score = fuzz.ratio(query.lower(), track.lower())
         if score > top[1]:
@@ -86,100 +924,396 @@ def find_song(artist, query) -> str|bool:
             top = (track, score)
     return top[0]
 
-def query_ollama(user_prompt):
-    payload = {
-        "model": MODEL_NAME,
-        "messages": [
-            {"role": "system", "content": SYSTEM_PROMPT},
-            {"role": "user", "content": user_prompt}
-        ],
-        "stream": False
-    }
+if args.llm_attempts < 1:
+    raise SystemExit("--llm-attempts must be at least 1")
+llm_options = {"system_prompt": SYSTEM_PROMPT, "summary_prompt": SUMMARY_PROMPT,
+               "conversation": Conversation(args.max_turns, args.max_context_tokens), "attempts": args.llm_attempts,
+               "timeout": LLM_TIMEOUT, "delay": LLM_RETRY_DELAY, "stop": transcriber.stopping}
+if args.llm_endpoint:
+    responder = OpenAIResponder(args.llm_endpoint, args.llm_model, os.environ.get(LLM_API_KEY_ENV), **llm_options)
+else:
+    responder = OllamaResponder(OLLAMA_URL, args.llm_model, **llm_options)
+
+class Speaker:
+    """Speaks text aloud, muting capture meanwhile so we don't transcribe ourselves."""
+
+    def __init__(self):
+        self.engine = tts.init()
+        self.lock = threading.Lock()
+
+    def say(self, text):
+        with self.lock, capture_mute:
+            self.engine.say(text)
+            self.engine.runAndWait()
+
+    def stop(self):
+        # runAndWait() returns once the engine stops, dropping anything queued
+        self.engine.stop()
+
+speaker = None if args.no_tts else Speaker()
+
+wake_gate = WakeGate(args.wake_word, args.wake_timeout) if args.wake_word else None
+
+def deliver_reply(reply):
+    emit("reply", text=reply)
+    if speaker:
+        speaker.say(reply)
+
+commands = CommandRegistry()
+
+@commands.exact("what time is it")
+def tell_time():
+    return "It's " + datetime.now().strftime("%I:%M %p").lstrip("0")
+
+@commands.exact("what did i just say", "what did i say")
+def repeat_last():
+    # the newest transcript is this question
+    previous = history.recent(2)
+    return f"You said: {previous[0]['text']}" if len(previous) == 2 else "I haven't heard anything yet"
 
+@commands.exact("summarize", "summarize the session", "summarize the meeting")
+def summarize_session():
+    # the newest transcript is this request
+    lines = session.all()[:-1]
+    if not lines:
+        return "There's nothing to summarize yet"
+    log.info("Summarizing %d transcript(s)", len(lines))
+    return summarize_lines(lines)
+
+def summarize_lines(lines) -> str:
+    # more than fits the context budget is summarized in parts, and then the
+    # summaries of the parts, until they fit
+    parts = [[]]
+    used = 0
+    for line in lines:
+        tokens = estimate_tokens(line)
+        if parts[-1] and used + tokens > args.max_context_tokens:
+            parts.append([])
+            used = 0
+        parts[-1].append(line)
+        used += tokens
+    # one line a part would get nowhere, those go in whole
+    if len(parts) == 1 or len(parts) == len(lines):
+        return responder.summarize("\n".join(lines))
+    log.info("Summarizing in %d parts", len(parts))
+    return summarize_lines([responder.summarize("\n".join(part)) for part in parts])
+
+@commands.exact("replay that", "play that back")
+def replay_last():
+    if not replay:
+        return "Start me with --replay to keep audio for replaying"
+    # the newest utterance is this request
+    text = replay.play(2)
+    return f"That was heard as: {text}" if text is not None else "There's nothing to replay yet"
+
+@commands.exact("stop listening")
+def stop_listening():
+    transcriber.stop()
+
+@commands.exact("clear", "new conversation")
+def clear_context():
+    responder.reset()
+    log.info("Cleared session context")
+
+@commands.exact("volume up")
+def volume_up():
+    subprocess.run(["mpc", "volume", "100"])
+
+@commands.exact("volume down")
+def volume_down():
+    subprocess.run(["mpc", "volume", "60"])
+
+@commands.exact("stop")
+def stop_music():
+    subprocess.run(["mpc", "stop"])
+
+@commands.exact("pause")
+def pause_music():
+    subprocess.run(["mpc", "pause"])
+
+@commands.exact("play", "resume")
+def resume_music():
+    subprocess.run(["mpc", "play"])
+
+@commands.exact("shuffle all songs")
+def shuffle_all():
+    subprocess.run(["mpc", "clear"])
+    subprocess.run(["mpc", "add", "/"])
+    subprocess.run(["mpc", "shuffle"])
+    subprocess.run(["mpc", "play"])
+
+@commands.exact("skip")
+def next_track():
+    subprocess.run(["mpc", "next"])
+
+@commands.exact("rewind", "go back")
+def previous_track():
+    subprocess.run(["mpc", "prev"])
+
+@commands.pattern(r"play\S*(?: (.*))?")
+def play_query(query):
+    subquery = (query or "").split(" by ")
+    if len(subquery) > 1:
+        title = subquery[0]
+        artist = find_artist(subquery[1])
+        res = find_song(artist, title)
+        subprocess.run(["mpc", "clear"])
+        subprocess.run(["mpc", "findadd", "artist", artist, "title", res])
+        subprocess.run(["mpc", "play"])
+    else:
+        res = find_any(query or "")
+        subprocess.run(["mpc", "clear"])
+        subprocess.run(["mpc", "findadd", "title", res])
+        subprocess.run(["mpc", "play"])
+
+@commands.pattern(r"shuffle(?: (.*))?")
+def shuffle_artist(query):
+    split = (query or "").split(" by ")
+    artist = find_artist(" ".join(split[1:]))
+    subprocess.run(["mpc", "clear"])
+    subprocess.run(["mpc", "findadd", "artist", artist])
+    subprocess.run(["mpc", "play"])
+
+class Deduper:
+    """Drops transcripts that repeat the previous one, as a stutter in the
+    endpointing can produce the same phrase twice back to back."""
+
+    def __init__(self, similarity, window):
+        self.similarity = similarity
+        self.window = window
+        self.last = None
+
+    def is_repeat(self, segment) -> bool:
+        last, self.last = self.last, segment
+        if last is None or segment.start - last.end > self.window:
+            return False
+        score = fuzz.ratio(" ".join(last.text.split()), " ".join(segment.text.split()))
+        if score >= self.similarity:
+            log.debug("Dropped %r, %d%% like the transcript before it", segment.text, score)
+            return True
+        return False
+
+deduper = Deduper(args.dedupe, DEDUPE_WINDOW) if args.dedupe is not None else None
+turns = TurnTracker() if args.turns else None
+
+def record_segment(segment):
+    # everything recognized is kept, whether or not the wake word let it through
+    segment = replace(segment, text=tidy(segment.text))
+    session.add(segment.text)
+    if audio_archive:
+        audio_archive.save(segment)
+    if subtitles:
+        subtitles.add(segment)
+    if replay:
+        replay.add(segment)
+
+def retranscribe(segment) -> str|None:
+    # the small model only had to catch the wake word, the main one gets the
+    # whole utterance, with the wake word dropped again if it has it too
+    text = " ".join(s.text for s in accurate.transcribe(bytes_to_int16(segment.audio)))
+    rest = wake_gate.after(text)
+    return (text if rest is None else rest) or None
+
+def misheard(segment) -> bool:
+    # a transcript without words to score is given the benefit of the doubt
+    if not args.llm_min_confidence or segment.confidence is None:
+        return False
+    return segment.confidence < args.llm_min_confidence
+
+# set once --once has its transcript, anything after it is dropped
+transcribed = threading.Event()
+
+def handle_segment(segment):
+    if args.once and transcribed.is_set():
+        return
+    if wake_gate:
+        text = wake_gate.filter(segment.text)
+        if text and wake_model:
+            text = retranscribe(segment)
+        if not text:
+            return
+        segment = replace(segment, text=text)
+    pending_text = tidy(segment.text)
+    # nothing in a segment may have been loud enough to count as speech,
+    # with --ptt say, and then there's no end of it to measure from
+    latency = time.monotonic() - segment.speech_end if segment.speech_end is not None else None
+    metrics.inc("transcriptions_total")
+    if latency is not None:
+        metrics.observe("latency_seconds", latency)
+        log.debug("%r took %.2fs from the end of speech, %.3fs of it decoding", pending_text, latency, segment.decode_time)
+    fields = {"words": [asdict(w) for w in segment.words]} if args.words else {}
+    if segment.turn is not None:
+        fields["turn"] = segment.turn
+    match = commands.match(segment.text)
+    if match:
+        handler, groups = match
+        fields.update(kind="command", command=handler.__name__, args=list(groups))
+    else:
+        fields["kind"] = "dictation"
+    emit("transcription", text=pending_text, start=segment.start, duration=segment.end - segment.start,
+         start_time=wall_clock(segment.start), level=segment.level, confidence=segment.confidence,
+         language=reloader.language or args.lang, latency=latency, decode_time=segment.decode_time, **fields)
+    history.add({"text": pending_text, "start": segment.start, "start_time": wall_clock(segment.start),
+                 "duration": segment.end - segment.start})
+    if transcript_log:
+        transcript_log.write(pending_text)
+    if clipboard:
+        clipboard.copy(pending_text)
+    if args.once:
+        transcribed.set()
+        transcriber.stop()
+        return
+    # past the wake gate everything is meant for us, whose phrase it strips,
+    # otherwise only what starts with the bot's name is
+    addressed = bool(wake_gate) or segment.text.split()[0] == BOT_NAME
     try:
-        response = requests.post(OLLAMA_URL, json=payload)
-        response.raise_for_status()
-        result = response.json()
-        ollama_response = result.get("message", "No response from Ollama")
-        return ollama_response["content"]
-    except requests.RequestException as e:
-        return f"Error querying Ollama: {e}"
+        if match:
+            reply = handler(*groups)
+            if reply:
+                deliver_reply(reply)
+        elif addressed and misheard(segment):
+            log.info("Not asking the LLM about %r, confidence %.2f is below %.2f", pending_text, segment.confidence,
+                     args.llm_min_confidence)
+            metrics.inc("llm_prompts_skipped_total")
+            if args.ask_repeat:
+                deliver_reply(REPEAT_PROMPT)
+        elif addressed:
+            try:
+                reply = responder.respond(pending_text)
+            except (requests.RequestException, KeyError, IndexError) as e:
+                report_error(f"Error querying LLM: {e}")
+            else:
+                deliver_reply(reply)
     except Exception as e:
-        return e
+        report_error(e)
 
-print("Listening... (Ctrl+C to stop)\n")
+class WorkerPool:
+    """Handles transcripts off the capture thread so slow commands don't drop audio."""
 
-try:
-    pending_text = None
-    while True:
-        data = stream.read(CHUNK, exception_on_overflow=False)
-        # audio_data = np.frombuffer(data, dtype=np.int16)
-        # amp = np.max(np.abs(audio_data))
-        if rec.AcceptWaveform(data):
-            result = json.loads(rec.Result())
-            transcribed_text = result.get("text")
-            if transcribed_text:
-                pending_text = transcribed_text
-
-        if pending_text:
-            print("\n> ", pending_text)
-            parts = pending_text.split()
-            try:
-                if pending_text == "clear":
-                    conversation_history = []
-                    print("\n----- cleared session context -----\n")
-                elif pending_text == "volume up":
-                    subprocess.run(["mpc", "volume", "100"])
-                elif pending_text == "volume down":
-                    subprocess.run(["mpc", "volume", "60"])
-                elif pending_text == "stop":
-                    subprocess.run(["mpc", "stop"])
-                elif pending_text == "pause":
-                    subprocess.run(["mpc", "pause"])
-                elif pending_text == "play" or pending_text == "resume":
-                    subprocess.run(["mpc", "play"])
-                elif pending_text == "shuffle all songs":
-                    subprocess.run(["mpc", "clear"])
-                    subprocess.run(["mpc", "add", "/"])
-                    subprocess.run(["mpc", "shuffle"])
-                    subprocess.run(["mpc", "play"])
-                elif pending_text == "skip":
-                    subprocess.run(["mpc", "next"])
-                elif pending_text == "rewind" or pending_text == "go back":
-                    subprocess.run(["mpc", "prev"])
-                elif parts[0].startswith("play"):
-                    subquery = " ".join(parts[1:]).split(" by ")
-                    if len(subquery) > 1:
-                        title = subquery[0]
-                        artist = find_artist(subquery[1])
-                        res = find_song(artist, title)
-                        subprocess.run(["mpc", "clear"])
-                        subprocess.run(["mpc", "findadd", "artist", artist, "title", res])
-                        subprocess.run(["mpc", "play"])
-                    else:
-                        res = find_any(" ".join(parts[1:]))
-                        subprocess.run(["mpc", "clear"])
-                        subprocess.run(["mpc", "findadd", "title", res])
-                        subprocess.run(["mpc", "play"])
-                elif parts[0] == "shuffle":
-                    split = " ".join(parts[1:]).split(" by ")
-                    artist = find_artist(" ".join(split[1:]))
-                    subprocess.run(["mpc", "clear"])
-                    subprocess.run(["mpc", "findadd", "artist", artist])
-                    subprocess.run(["mpc", "play"])
-                elif parts[0] == BOT_NAME:
-                    ollama_response = query_ollama(pending_text)
-                    print("\n" + ollama_response)
-                print()
-            except Exception as e:
-                print(e)
-                pass
-
-        pending_text = None
+    def __init__(self, count, size, policy, handler):
+        self.queue = queue.Queue(maxsize=size)
+        self.policy = policy
+        self.handler = handler
+        self.threads = [threading.Thread(target=self.run, daemon=True) for _ in range(count)]
+        for t in self.threads:
+            t.start()
+
+    def submit(self, segment):
+        # with "block", capture waits here and it's audio that gets lost instead
+        dropped = enqueue(self.queue, segment, self.policy)
+        if dropped is not None:
+            metrics.inc("transcripts_dropped_total")
+            log.warning("Transcript queue full, dropped %r", dropped.text)
+
+    def run(self):
+        while True:
+            segment = self.queue.get()
+            if segment is None:
+                return
+            self.handler(segment)
+
+    def close(self, timeout) -> bool:
+        deadline = time.monotonic() + timeout
+        try:
+            for _ in self.threads:
+                self.queue.put(None, timeout=max(0, deadline - time.monotonic()))
+        except queue.Full:
+            return False
+        for t in self.threads:
+            t.join(max(0, deadline - time.monotonic()))
+        return not any(t.is_alive() for t in self.threads)
+
+if args.workers < 1:
+    raise SystemExit("--workers must be at least 1")
+if args.transcript_queue < 1:
+    raise SystemExit("--transcript-queue must be at least 1")
+workers = WorkerPool(args.workers, args.transcript_queue, args.transcript_overflow, handle_segment)
+
+if args.stdin:
+    source = PipeAudioSource(sys.stdin.buffer, chunk)
+elif args.input_file:
+    try:
+        source = FileAudioSource(args.input_file, chunk)
+    except (OSError, wave.Error, EOFError, ValueError) as e:
+        raise SystemExit(f"Can't read {args.input_file}: {e}")
+else:
+    try:
+        source = MicrophoneSource(args.device, None if args.capture_rate == "native" else args.capture_rate,
+                                  args.channels, args.mono_mix, STALL_TIMEOUT if args.reconnect else None, RECONNECT_MAX_DELAY,
+                                  chunk, args.sample_format)
+    except OSError as e:
+        raise SystemExit(f"Can't open the capture device: {e}")
+if args.decode_nice is not None:
+    source = ThreadedSource(source, chunks(CAPTURE_BUFFER))
+
+def toggle_pause(signum, frame):
+    # only flip the flag, the capture thread logs the change as logging isn't
+    # safe from a signal handler
+    if transcriber.paused.is_set():
+        transcriber.paused.clear()
+    else:
+        transcriber.paused.set()
+
+signal.signal(signal.SIGUSR1, toggle_pause)
+
+def reload_in_background():
+    try:
+        reloader.reload()
+    except Exception as e:
+        report_error(f"Reloading the model failed: {e}")
+
+# loading a model takes a while, and isn't something for a signal handler
+signal.signal(signal.SIGHUP, lambda signum, frame: threading.Thread(target=reload_in_background, daemon=True).start())
 
+def take(segment):
+    if deduper and deduper.is_repeat(segment):
+        return
+    metrics.observe("decode_seconds", segment.decode_time)
+    if turns:
+        # here rather than on the workers so the turns go in the order spoken
+        turns.update(segment)
+    record_segment(segment)
+    workers.submit(segment)
+
+if calibrator:
+    log.info("Measuring the background noise, stay quiet for %ss", CALIBRATE_SECONDS)
+log.info("Listening... (Ctrl+C to stop)")
+
+if args.timeout:
+    timer = threading.Timer(args.timeout, transcriber.stop)
+    timer.daemon = True
+    timer.start()
+
+segments = transcriber.start(source)
+try:
+    for segment in segments:
+        take(segment)
 except KeyboardInterrupt:
-    print("\nStopping...")
+    log.info("Stopping...")
 finally:
-    stream.stop_stream()
-    stream.close()
-    p.terminate()
+    # the utterance in progress is flushed into the results on the way out
+    transcriber.close()
+    for segment in segments:
+        take(segment)
+    # let queued transcripts finish, but don't hang on a slow command or LLM call
+    if not workers.close(SHUTDOWN_TIMEOUT):
+        log.warning("Gave up waiting for transcripts to be handled after %ss", SHUTDOWN_TIMEOUT)
+    sinks.close()
+    if transcript_log:
+        transcript_log.close()
+    if session_wav:
+        session_wav.close()
+    if stats_csv:
+        stats_csv.close()
+    if audio_archive:
+        audio_archive.close()
+    if subtitles:
+        subtitles.write()
+    if ws_server:
+        ws_server.close()
+    if http_server:
+        http_server.shutdown()
+
+if args.once and not transcribed.is_set():
+    log.error("Nothing was transcribed")
+    raise SystemExit(1)
@@ -0,0 +1,104 @@
+import struct
+import tracemalloc
+import unittest
+
+import numpy as np
+
+from jarvis.audio import CHUNK, TransientSuppressor, bytes_to_int16, convert_to_int16, int16_to_bytes
+
+
+class ConvertToInt16Test(unittest.TestCase):
+    def test_s16_passes_through(self):
+        data = struct.pack("<4h", 0, 1, -1, 32767)
+        self.assertEqual(convert_to_int16("s16", data).tolist(), [0, 1, -1, 32767])
+
+    def test_s24_keeps_the_top_16_bits(self):
+        # little-endian 24-bit: 0x123456 keeps 0x1234
+        data = bytes([0x56, 0x34, 0x12, 0xff, 0xff, 0x7f])
+        self.assertEqual(convert_to_int16("s24", data).tolist(), [0x1234, 0x7fff])
+
+    def test_s24_sign_extends_negative_samples(self):
+        # -1, -256 and the most negative 24-bit value
+        data = bytes([0xff, 0xff, 0xff, 0x00, 0xff, 0xff, 0x00, 0x00, 0x80])
+        self.assertEqual(convert_to_int16("s24", data).tolist(), [-1, -1, -32768])
+
+    def test_s24_drops_a_partial_sample(self):
+        data = bytes([0x00, 0x00, 0x40, 0x00, 0x00])
+        self.assertEqual(convert_to_int16("s24", data).tolist(), [0x4000])
+
+    def test_f32_scales_full_scale_to_16_bits(self):
+        data = np.array([0.0, 0.5, 1.0, -1.0], dtype="<f4").tobytes()
+        self.assertEqual(convert_to_int16("f32", data).tolist(), [0, 16384, 32767, -32767])
+
+    def test_f32_clips_past_full_scale(self):
+        data = np.array([1.5, -1.5, 100.0], dtype="<f4").tobytes()
+        self.assertEqual(convert_to_int16("f32", data).tolist(), [32767, -32768, 32767])
+
+    def test_unknown_format(self):
+        with self.assertRaises(ValueError):
+            convert_to_int16("u8", b"\x00\x00")
+
+
+class Int16BytesTest(unittest.TestCase):
+    def test_round_trip(self):
+        data = struct.pack("<5h", 0, 1, -1, 32767, -32768)
+        samples = bytes_to_int16(data)
+        self.assertEqual(samples.tolist(), [0, 1, -1, 32767, -32768])
+        self.assertEqual(int16_to_bytes(samples), data)
+
+    def test_odd_length_drops_the_trailing_byte(self):
+        data = struct.pack("<2h", 1000, -1000) + b"\x7f"
+        samples = bytes_to_int16(data)
+        self.assertEqual(samples.tolist(), [1000, -1000])
+        self.assertEqual(int16_to_bytes(samples), data[:-1])
+
+    def test_empty_and_single_byte(self):
+        self.assertEqual(len(bytes_to_int16(b"")), 0)
+        self.assertEqual(len(bytes_to_int16(b"\x01")), 0)
+        self.assertEqual(int16_to_bytes(bytes_to_int16(b"\x01")), b"")
+
+    def test_wider_samples_are_narrowed_once(self):
+        samples = np.array([0, 1, -1, 32767], dtype=np.int32)
+        self.assertEqual(int16_to_bytes(samples), struct.pack("<4h", 0, 1, -1, 32767))
+
+
+class ChunkAllocationTest(unittest.TestCase):
+    """Both run on every captured chunk, so neither should copy more than it has to."""
+
+    def test_bytes_to_int16_views_the_buffer(self):
+        data = bytes(CHUNK * 2 + 1)
+        samples = bytes_to_int16(data)
+        self.assertFalse(samples.flags.owndata)
+        self.assertTrue(np.shares_memory(samples, np.frombuffer(data, dtype=np.uint8)))
+
+    def test_int16_to_bytes_copies_once(self):
+        samples = np.zeros(CHUNK * 16, dtype=np.int16)
+        tracemalloc.start()
+        try:
+            data = int16_to_bytes(samples)
+            peak = tracemalloc.get_traced_memory()[1]
+        finally:
+            tracemalloc.stop()
+        self.assertEqual(len(data), samples.nbytes)
+        # the bytes returned, plus a little bookkeeping, but not a second array
+        self.assertLess(peak, samples.nbytes * 1.5)
+
+
+class TransientSuppressorTest(unittest.TestCase):
+    def test_holds_back_a_short_chunk(self):
+        suppressor = TransientSuppressor(0.01, 4)
+        self.assertEqual(len(suppressor.process(np.zeros(10, dtype=np.int16))), 0)
+
+    def test_flush_returns_what_was_held_back(self):
+        suppressor = TransientSuppressor(0.01, 4)
+        lag = (suppressor.max_frames + 1) * suppressor.frame
+        samples = np.arange(CHUNK, dtype=np.int16) % 40 - 20  # steady and quiet, left alone
+        out = np.concatenate([suppressor.process(samples), suppressor.flush()])
+        self.assertEqual(len(out), lag + len(samples))
+        self.assertEqual(out[lag:].tolist(), samples.tolist())
+        # and starts over
+        self.assertEqual(len(suppressor.flush()), lag)
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,90 @@
+import http.server
+import json
+import threading
+import unittest
+
+import requests
+
+from jarvis.llm import post_with_retries
+
+
+class FlakyServer(http.server.HTTPServer):
+    """Answers each POST with the next status in statuses, repeating the last."""
+
+    def __init__(self, statuses):
+        super().__init__(("127.0.0.1", 0), FlakyHandler)
+        self.statuses = list(statuses)
+        self.requests = 0
+
+    @property
+    def url(self):
+        return f"http://127.0.0.1:{self.server_port}/"
+
+
+class FlakyHandler(http.server.BaseHTTPRequestHandler):
+    def do_POST(self):
+        self.rfile.read(int(self.headers["Content-Length"]))
+        server = self.server
+        status = server.statuses[min(server.requests, len(server.statuses) - 1)]
+        server.requests += 1
+        body = json.dumps({"status": status}).encode()
+        self.send_response(status)
+        self.send_header("Content-Type", "application/json")
+        self.send_header("Content-Length", str(len(body)))
+        self.end_headers()
+        self.wfile.write(body)
+
+    def log_message(self, format, *args):
+        pass
+
+
+class PostWithRetriesTest(unittest.TestCase):
+    def serve(self, *statuses):
+        server = FlakyServer(statuses)
+        threading.Thread(target=server.serve_forever, daemon=True).start()
+        self.addCleanup(server.server_close)
+        self.addCleanup(server.shutdown)
+        return server
+
+    def post(self, server, **kwargs):
+        kwargs.setdefault("attempts", 3)
+        return post_with_retries(server.url, {"prompt": "hi"}, timeout=5, delay=0.01, **kwargs)
+
+    def test_retries_server_error(self):
+        server = self.serve(500, 200)
+        with self.assertLogs("jarvis.llm", "WARNING"):
+            response = self.post(server)
+        self.assertEqual(response.json(), {"status": 200})
+        self.assertEqual(server.requests, 2)
+
+    def test_retries_too_many_requests(self):
+        server = self.serve(429, 429, 200)
+        with self.assertLogs("jarvis.llm", "WARNING"):
+            self.assertEqual(self.post(server).status_code, 200)
+        self.assertEqual(server.requests, 3)
+
+    def test_client_error_is_not_retried(self):
+        server = self.serve(400, 200)
+        with self.assertRaises(requests.HTTPError):
+            self.post(server)
+        self.assertEqual(server.requests, 1)
+
+    def test_gives_up_after_attempts(self):
+        server = self.serve(503)
+        with self.assertLogs("jarvis.llm", "WARNING"), self.assertRaisesRegex(requests.RequestException,
+                                                                              "after 3 attempts"):
+            self.post(server)
+        self.assertEqual(server.requests, 3)
+
+    def test_stop_cuts_the_wait_short(self):
+        server = self.serve(500, 200)
+        stop = threading.Event()
+        stop.set()
+        with self.assertLogs("jarvis.llm", "WARNING"), self.assertRaisesRegex(requests.RequestException,
+                                                                              "shutting down"):
+            self.post(server, stop=stop)
+        self.assertEqual(server.requests, 1)
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,89 @@
+import io
+import tempfile
+import unittest
+import zipfile
+from pathlib import Path
+from unittest import mock
+
+from jarvis.models import download_model
+
+
+NAME = "vosk-model-small-xx-0.1"
+
+
+def model_zip() -> bytes:
+    buffer = io.BytesIO()
+    with zipfile.ZipFile(buffer, "w") as z:
+        z.writestr(f"{NAME}/am/final.mdl", b"\0B")
+    return buffer.getvalue()
+
+
+class FakeResponse:
+    """A streamed download that hands over blocks and then raises error, if given."""
+
+    def __init__(self, blocks, error=None):
+        self.blocks = blocks
+        self.error = error
+        self.headers = {"Content-Length": str(sum(len(b) for b in blocks))}
+
+    def __enter__(self):
+        return self
+
+    def __exit__(self, *exc_info):
+        pass
+
+    def raise_for_status(self):
+        pass
+
+    def iter_content(self, size):
+        yield from self.blocks
+        if self.error:
+            raise self.error
+
+
+class InterruptedDownloadTest(unittest.TestCase):
+    def setUp(self):
+        self.model_dir = Path(self.enterContext(tempfile.TemporaryDirectory()))
+        self.models = [{"name": NAME, "url": f"https://example.com/{NAME}.zip"}]
+
+    def assert_cleaned_up(self):
+        self.assertEqual(list(self.model_dir.glob("*.zip.part")), [])
+        self.assertEqual(list(self.model_dir.glob(".*.unpack")), [])
+        self.assertFalse((self.model_dir / NAME).exists())
+
+    def download(self, response):
+        # the progress goes to stderr
+        with mock.patch("jarvis.models.requests.get", return_value=response), mock.patch("sys.stderr", io.StringIO()):
+            return download_model(NAME, self.models, self.model_dir)
+
+    def test_ctrl_c_while_downloading(self):
+        with self.assertRaises(KeyboardInterrupt):
+            self.download(FakeResponse([model_zip()[:10]], KeyboardInterrupt()))
+        self.assert_cleaned_up()
+
+    def test_sigterm_while_downloading(self):
+        # what run.py's SIGTERM handler raises
+        with self.assertRaises(SystemExit):
+            self.download(FakeResponse([model_zip()[:10]], SystemExit(143)))
+        self.assert_cleaned_up()
+
+    def test_ctrl_c_while_unpacking(self):
+        with mock.patch.object(zipfile.ZipFile, "extractall", side_effect=KeyboardInterrupt):
+            with self.assertRaises(KeyboardInterrupt):
+                self.download(FakeResponse([model_zip()]))
+        self.assert_cleaned_up()
+
+    def test_sigterm_while_unpacking(self):
+        def extract_some(z, path):
+            # part of the model is already out when the signal comes
+            z.extract(z.namelist()[0], path)
+            raise SystemExit(143)
+        with mock.patch.object(zipfile.ZipFile, "extractall", autospec=True, side_effect=extract_some):
+            with self.assertRaises(SystemExit):
+                self.download(FakeResponse([model_zip()]))
+        self.assert_cleaned_up()
+
+    def test_finished_download_is_kept(self):
+        path = self.download(FakeResponse([model_zip()]))
+        self.assertTrue((path / "am" / "final.mdl").is_file())
+        self.assertEqual([p.name for p in self.model_dir.iterdir()], [NAME])
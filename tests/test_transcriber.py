@@ -0,0 +1,175 @@
+import json
+import struct
+import unittest
+from unittest import mock
+
+from jarvis.audio import CHUNK, RATE, VoiceActivityDetector
+from jarvis.transcriber import RESTART_LIMIT, Transcriber
+
+
+class FakeRecognizer:
+    """Recognizes "hello" in any run of speech it's fed, or the model's name
+    if it has one."""
+
+    def __init__(self, model, *args):
+        self.model = model
+        self.fed = 0
+
+    def SetWords(self, words):
+        pass
+
+    def AcceptWaveform(self, data):
+        self.fed += len(data)
+        return False
+
+    def PartialResult(self):
+        return json.dumps({"partial": ""})
+
+    def Result(self):
+        return json.dumps({"text": ""})
+
+    def FinalResult(self):
+        text = (self.model or "hello") if self.fed else ""
+        self.fed = 0
+        return json.dumps({"text": text})
+
+
+def chunk(value):
+    return struct.pack(f"<{CHUNK}h", *[value] * CHUNK)
+
+
+class ScriptedSource:
+    """Reads chunks from a list, raising the exceptions in it instead of
+    returning them, and EOFError once it runs out."""
+
+    def __init__(self, script):
+        self.script = list(script)
+        self.closed = False
+
+    def read(self):
+        if not self.script:
+            raise EOFError
+        item = self.script.pop(0)
+        if isinstance(item, Exception):
+            raise item
+        return item
+
+    def close(self):
+        self.closed = True
+
+
+class FailingSource(ScriptedSource):
+    def __init__(self):
+        super().__init__([])
+        self.reads = 0
+
+    def read(self):
+        self.reads += 1
+        raise ValueError("bad chunk")
+
+
+class LaggingFilter:
+    """Passes chunks on one chunk late, like a filter looking ahead."""
+
+    def __init__(self):
+        self.held = None
+
+    def process(self, samples):
+        out, self.held = self.held, samples
+        return out if out is not None else samples[:0]
+
+    def flush(self):
+        out, self.held = self.held, None
+        return out
+
+
+@mock.patch("jarvis.transcriber.KaldiRecognizer", FakeRecognizer)
+class LookaheadTest(unittest.TestCase):
+    def test_end_of_the_audio_is_flushed_out_of_the_filters(self):
+        # the source runs out mid-utterance, with one chunk still in the filter
+        source = ScriptedSource([chunk(0)] * 3 + [chunk(2000)] * 5)
+        transcriber = Transcriber(None, VoiceActivityDetector(600, 2, 3), filters=[LaggingFilter()])
+        segments = list(transcriber.start(source))
+        self.assertEqual([segment.text for segment in segments], ["hello"])
+        self.assertEqual(segments[0].end, 8 * CHUNK / RATE)
+
+
+class EndpointingRecognizer(FakeRecognizer):
+    """Ends an utterance at every quiet chunk, like vosk can while the VAD is
+    still in its hangover."""
+
+    def AcceptWaveform(self, data):
+        super().AcceptWaveform(data)
+        return not any(data)
+
+    def Result(self):
+        self.fed = 0
+        return json.dumps({"text": "hello"})
+
+
+@mock.patch("jarvis.transcriber.KaldiRecognizer", EndpointingRecognizer)
+class SpeechEndTest(unittest.TestCase):
+    def test_segments_without_loud_chunks_have_no_speech_end(self):
+        source = ScriptedSource([chunk(0)] * 3 + [chunk(2000)] * 5 + [chunk(0)] * 5)
+        segments = list(Transcriber(None, VoiceActivityDetector(600, 2, 3)).start(source))
+        self.assertGreater(len(segments), 1)
+        self.assertIsNotNone(segments[0].speech_end)
+        # the ones after it were only the quiet, and mustn't keep its value
+        self.assertEqual([segment.speech_end for segment in segments[1:]], [None] * (len(segments) - 1))
+
+
+@mock.patch("jarvis.transcriber.KaldiRecognizer", FakeRecognizer)
+class SetModelTest(unittest.TestCase):
+    def test_utterance_in_progress_finishes_with_the_old_model(self):
+        speech = [chunk(0)] * 3 + [chunk(2000)] * 5 + [chunk(0)] * 5
+        transcriber = Transcriber("old", VoiceActivityDetector(600, 2, 3))
+
+        class Switching(ScriptedSource):
+            def read(self):
+                if len(self.script) == 2 * len(speech) - 5:
+                    transcriber.set_model("new")  # two chunks into the first utterance
+                return super().read()
+
+        segments = list(transcriber.start(Switching(speech * 2)))
+        self.assertEqual([segment.text for segment in segments], ["old", "new"])
+        # from the onset the VAD triggered on, not cut off where the model changed
+        self.assertEqual(segments[0].start, 2 * CHUNK / RATE)
+
+
+@mock.patch("jarvis.transcriber.KaldiRecognizer", FakeRecognizer)
+class RestartTest(unittest.TestCase):
+    def transcribe(self, source):
+        warnings = []
+        transcriber = Transcriber(None, VoiceActivityDetector(600, 2, 3), on_warning=warnings.append)
+        return transcriber, warnings, transcriber.start(source)
+
+    def test_recovers_from_a_failed_read(self):
+        speech = [chunk(0)] * 3 + [chunk(2000)] * 5 + [chunk(0)] * 5
+        source = ScriptedSource(speech + [ValueError("bad chunk")] + speech)
+        transcriber, warnings, segments = self.transcribe(source)
+        self.assertEqual([segment.text for segment in segments], ["hello", "hello"])
+        self.assertEqual(len(warnings), 1)
+        self.assertIn("restarting", warnings[0])
+        # a finished utterance means the recognizer works again
+        self.assertEqual(transcriber.restarts, 0)
+        self.assertTrue(source.closed)
+
+    def test_gives_up_after_the_restart_limit(self):
+        source = FailingSource()
+        transcriber, warnings, segments = self.transcribe(source)
+        with self.assertRaisesRegex(ValueError, "bad chunk"):
+            list(segments)
+        self.assertEqual(len(warnings), RESTART_LIMIT)
+        self.assertEqual(source.reads, RESTART_LIMIT + 1)
+        self.assertTrue(source.closed)
+
+    def test_lost_device_is_not_restarted(self):
+        source = ScriptedSource([chunk(0), OSError("device unplugged"), chunk(0)])
+        transcriber, warnings, segments = self.transcribe(source)
+        with self.assertRaises(OSError):
+            list(segments)
+        self.assertEqual(warnings, [])
+
+
+if __name__ == "__main__":
+    unittest.main()